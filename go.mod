@@ -4,6 +4,7 @@ go 1.14
 
 require (
 	github.com/golang/protobuf v1.4.3
+	github.com/hashicorp/consul/api v1.7.0
 	github.com/hashicorp/go-hclog v0.14.1
 	github.com/hashicorp/nomad v1.0.2
 	github.com/hashicorp/nomad/api v0.0.0-20210115191909-bcd4752fc902
@@ -0,0 +1,297 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/hashicorp/nomad/api"
+	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
+)
+
+// EventType is the kind of change reported by an Event.
+type EventType string
+
+const (
+	// EventEvalMonitor is emitted when monitoring of an evaluation starts.
+	EventEvalMonitor EventType = "eval_monitor"
+
+	// EventEvalStatus is emitted when the status of the evaluation changes.
+	EventEvalStatus EventType = "eval_status"
+
+	// EventEvalComplete is emitted once the evaluation is done, Failed
+	// being the number of task groups that could not be placed and
+	// Description that of its status.
+	EventEvalComplete EventType = "eval_complete"
+
+	// EventEvalBlocked is emitted when a blocked evaluation waits for
+	// capacity to place the remaining allocations.
+	EventEvalBlocked EventType = "eval_blocked"
+
+	// EventPlacementFailure is emitted for every task group the
+	// evaluation failed to place.
+	EventPlacementFailure EventType = "placement_failure"
+
+	// EventAllocCreated is emitted for new allocations.
+	EventAllocCreated EventType = "alloc_created"
+
+	// EventAllocModified is emitted for existing allocations updated by
+	// the evaluation.
+	EventAllocModified EventType = "alloc_modified"
+
+	// EventAllocStatus is emitted when the client status of an allocation
+	// changes.
+	EventAllocStatus EventType = "alloc_status"
+
+	// EventTaskFailed is emitted when a task of an allocation fails, with
+	// its latest events and the end of its stderr.
+	EventTaskFailed EventType = "task_failed"
+
+	// EventTaskRestarted is emitted when a task of an allocation restarts,
+	// with its latest events.
+	EventTaskRestarted EventType = "task_restarted"
+
+	// EventDeploymentMonitor is emitted when monitoring of a deployment
+	// starts.
+	EventDeploymentMonitor EventType = "deployment_monitor"
+
+	// EventDeploymentStatus is emitted when the status of the deployment
+	// changes.
+	EventDeploymentStatus EventType = "deployment_status"
+
+	// EventStreamFallback is emitted when the event stream cannot be used
+	// and the monitor polls instead, Description being the reason.
+	EventStreamFallback EventType = "stream_fallback"
+)
+
+// Event is a change observed while monitoring an evaluation or a
+// deployment. Only the fields relevant to its Type are set.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+
+	EvalID       string `json:"eval_id,omitempty"`
+	AllocID      string `json:"alloc_id,omitempty"`
+	DeploymentID string `json:"deployment_id,omitempty"`
+
+	Group string `json:"group,omitempty"`
+	Node  string `json:"node,omitempty"`
+	Task  string `json:"task,omitempty"`
+
+	Status      string `json:"status,omitempty"`
+	PrevStatus  string `json:"prev_status,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	// Failed is the number of allocations, or task groups for
+	// EventEvalComplete, that could not be placed.
+	Failed int `json:"failed,omitempty"`
+
+	// Metrics are the placement metrics of an EventPlacementFailure.
+	Metrics *api.AllocationMetric `json:"metrics,omitempty"`
+
+	// Restarts, TaskEvents and Logs describe the task of an
+	// EventTaskFailed or EventTaskRestarted, Logs being the end of its
+	// stderr.
+	Restarts   uint64   `json:"restarts,omitempty"`
+	TaskEvents []string `json:"task_events,omitempty"`
+	Logs       string   `json:"logs,omitempty"`
+}
+
+// Warning reports whether the event is a problem worth the user's
+// attention.
+func (e *Event) Warning() bool {
+	switch e.Type {
+	case EventPlacementFailure, EventEvalBlocked, EventStreamFallback,
+		EventTaskFailed, EventTaskRestarted:
+		return true
+	case EventEvalComplete:
+		return e.Failed > 0 || e.Status != "complete"
+	}
+	return false
+}
+
+// Message describes the event for humans.
+func (e *Event) Message() string {
+	switch e.Type {
+	case EventEvalMonitor:
+		return fmt.Sprintf("Monitoring evaluation %q", e.EvalID)
+
+	case EventEvalStatus:
+		return fmt.Sprintf("Evaluation status changed: %q -> %q",
+			e.PrevStatus, e.Status)
+
+	case EventEvalComplete:
+		if e.Failed == 0 {
+			description := ""
+			if e.Description != "" {
+				description = fmt.Sprintf(" (%s)", e.Description)
+			}
+			return fmt.Sprintf("Evaluation %q finished with status %q%s",
+				e.EvalID, e.Status, description)
+		}
+		return fmt.Sprintf("Evaluation %q finished with status %q but failed to place all allocations",
+			e.EvalID, e.Status)
+
+	case EventEvalBlocked:
+		return fmt.Sprintf("Evaluation %q waiting for additional capacity to place remainder",
+			e.EvalID)
+
+	case EventPlacementFailure:
+		output := NewPlacementFailure(e.Group, e.Metrics).Summary()
+		if reasons := FormatAllocMetrics(e.Metrics, "  "); reasons != "" {
+			output += ":\n" + reasons
+		}
+		return output
+
+	case EventAllocCreated:
+		return fmt.Sprintf("Allocation %q created: node %q, group %q",
+			e.AllocID, e.Node, e.Group)
+
+	case EventAllocModified:
+		return fmt.Sprintf("Allocation %q modified: node %q, group %q",
+			e.AllocID, e.Node, e.Group)
+
+	case EventAllocStatus:
+		description := ""
+		if e.Description != "" {
+			description = fmt.Sprintf(" (%s)", e.Description)
+		}
+		return fmt.Sprintf("Allocation %q status changed: %q -> %q%s",
+			e.AllocID, e.PrevStatus, e.Status, description)
+
+	case EventTaskFailed, EventTaskRestarted:
+		what := "failed"
+		if e.Type == EventTaskRestarted {
+			what = "restarted"
+		}
+		output := fmt.Sprintf("Task %q of allocation %q %s (%d restarts)",
+			e.Task, e.AllocID, what, e.Restarts)
+		for _, line := range e.TaskEvents {
+			output += "\n  " + line
+		}
+		if e.Logs != "" {
+			output += "\n  stderr:"
+			for _, line := range strings.Split(e.Logs, "\n") {
+				output += "\n    " + line
+			}
+		}
+		return output
+
+	case EventDeploymentMonitor:
+		return fmt.Sprintf("Monitoring deployment %q", e.DeploymentID)
+
+	case EventDeploymentStatus:
+		description := ""
+		if e.Description != "" {
+			description = fmt.Sprintf(" (%s)", e.Description)
+		}
+		return fmt.Sprintf("Deployment %q status changed: %q%s",
+			e.DeploymentID, e.Status, description)
+
+	case EventStreamFallback:
+		return fmt.Sprintf("Event stream unavailable, polling instead: %s", e.Description)
+	}
+	return string(e.Type)
+}
+
+// Handler receives the events of a Monitor.
+type Handler func(*Event)
+
+// UIHandler returns a Handler writing events to st like StatusHandler,
+// except for placement failures shown as tables on ui, with the scores of
+// the best nodes if scores is set, followed by suggestions.
+func UIHandler(ui terminal.UI, st terminal.Status, scores bool) Handler {
+	status := StatusHandler(st)
+	return func(e *Event) {
+		if e.Type != EventPlacementFailure || e.Metrics == nil {
+			status(e)
+			return
+		}
+
+		f := NewPlacementFailure(e.Group, e.Metrics)
+		st.Step(terminal.StatusWarn, f.Summary())
+		if len(f.Reasons) > 0 {
+			ui.Table(f.ReasonTable())
+		}
+		if scores && len(f.Scores) > 0 {
+			ui.Table(f.ScoreTable(maxScores))
+		}
+		for _, s := range f.Suggestions {
+			st.Step(terminal.StatusWarn, "Suggestion: "+s)
+		}
+	}
+}
+
+// StatusHandler returns a Handler writing events to st, monitoring starts
+// as status updates and everything else as steps.
+func StatusHandler(st terminal.Status) Handler {
+	return func(e *Event) {
+		switch e.Type {
+		case EventEvalMonitor, EventDeploymentMonitor:
+			st.Update(e.Message())
+		default:
+			status := terminal.StatusOK
+			if e.Warning() {
+				status = terminal.StatusWarn
+			}
+			st.Step(status, e.Message())
+		}
+	}
+}
+
+// JSONHandler returns a Handler writing events to w as JSON, one per line.
+// Write errors are ignored, the events being informational.
+func JSONHandler(w io.Writer) Handler {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(e *Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(e)
+	}
+}
+
+// LogHandler returns a Handler logging events to log with structured
+// fields.
+func LogHandler(log hclog.Logger) Handler {
+	return func(e *Event) {
+		args := []interface{}{"type", string(e.Type)}
+		for _, f := range []struct {
+			key, value string
+		}{
+			{"eval_id", e.EvalID},
+			{"alloc_id", e.AllocID},
+			{"deployment_id", e.DeploymentID},
+			{"group", e.Group},
+			{"node", e.Node},
+			{"task", e.Task},
+			{"status", e.Status},
+			{"prev_status", e.PrevStatus},
+			{"description", e.Description},
+		} {
+			if f.value != "" {
+				args = append(args, f.key, f.value)
+			}
+		}
+		if e.Failed > 0 {
+			args = append(args, "failed", e.Failed)
+		}
+		if e.Restarts > 0 {
+			args = append(args, "restarts", e.Restarts)
+		}
+		if len(e.TaskEvents) > 0 {
+			args = append(args, "task_events", e.TaskEvents)
+		}
+
+		if e.Warning() {
+			log.Warn(e.Message(), args...)
+		} else {
+			log.Info(e.Message(), args...)
+		}
+	}
+}
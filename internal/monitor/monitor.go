@@ -0,0 +1,699 @@
+// Package monitor follows Nomad evaluations, the allocations they create
+// and deployments, reporting what happens as Events. It is shared by the
+// platform and release components.
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+const (
+	// blockingWait is the longest a blocking query waits for a change
+	// before returning the current state.
+	blockingWait = 5 * time.Minute
+
+	// updateWait is the amount of time to wait between status
+	// updates when the server does not report an index to block on.
+	updateWait = time.Second
+)
+
+// Client is the part of the Nomad API used by the monitor.
+type Client interface {
+	Evaluation(evalID string, q *api.QueryOptions) (*api.Evaluation, *api.QueryMeta, error)
+	EvaluationAllocations(evalID string, q *api.QueryOptions) ([]*api.AllocationListStub, *api.QueryMeta, error)
+	Deployment(deployID string, q *api.QueryOptions) (*api.Deployment, *api.QueryMeta, error)
+	DeploymentAllocations(deployID string, q *api.QueryOptions) ([]*api.AllocationListStub, *api.QueryMeta, error)
+	Allocation(allocID string, q *api.QueryOptions) (*api.Allocation, *api.QueryMeta, error)
+	JobAllocations(jobID string, all bool, q *api.QueryOptions) ([]*api.AllocationListStub, *api.QueryMeta, error)
+	Logs(alloc *api.Allocation, follow bool, task, logType, origin string, offset int64, cancel <-chan struct{}, q *api.QueryOptions) (<-chan *api.StreamFrame, <-chan error)
+	EventStream(ctx context.Context, topics map[api.Topic][]string, index uint64, q *api.QueryOptions) (<-chan *api.Events, error)
+}
+
+// NewClient returns a Client backed by a Nomad API client.
+func NewClient(client *api.Client) Client {
+	return &nomadClient{client: client}
+}
+
+type nomadClient struct {
+	client *api.Client
+}
+
+func (c *nomadClient) Evaluation(evalID string, q *api.QueryOptions) (*api.Evaluation, *api.QueryMeta, error) {
+	return c.client.Evaluations().Info(evalID, q)
+}
+
+func (c *nomadClient) EvaluationAllocations(evalID string, q *api.QueryOptions) ([]*api.AllocationListStub, *api.QueryMeta, error) {
+	return c.client.Evaluations().Allocations(evalID, q)
+}
+
+func (c *nomadClient) Deployment(deployID string, q *api.QueryOptions) (*api.Deployment, *api.QueryMeta, error) {
+	return c.client.Deployments().Info(deployID, q)
+}
+
+func (c *nomadClient) DeploymentAllocations(deployID string, q *api.QueryOptions) ([]*api.AllocationListStub, *api.QueryMeta, error) {
+	return c.client.Deployments().Allocations(deployID, q)
+}
+
+func (c *nomadClient) Allocation(allocID string, q *api.QueryOptions) (*api.Allocation, *api.QueryMeta, error) {
+	return c.client.Allocations().Info(allocID, q)
+}
+
+func (c *nomadClient) JobAllocations(jobID string, all bool, q *api.QueryOptions) ([]*api.AllocationListStub, *api.QueryMeta, error) {
+	return c.client.Jobs().Allocations(jobID, all, q)
+}
+
+func (c *nomadClient) Logs(alloc *api.Allocation, follow bool, task, logType, origin string, offset int64, cancel <-chan struct{}, q *api.QueryOptions) (<-chan *api.StreamFrame, <-chan error) {
+	return c.client.AllocFS().Logs(alloc, follow, task, logType, origin, offset, cancel, q)
+}
+
+func (c *nomadClient) EventStream(ctx context.Context, topics map[api.Topic][]string, index uint64, q *api.QueryOptions) (<-chan *api.Events, error) {
+	return c.client.EventStream().Stream(ctx, topics, index, q)
+}
+
+// evalState is used to store the current "state of the world"
+// in the context of monitoring an evaluation.
+type evalState struct {
+	id         string
+	status     string
+	desc       string
+	node       string
+	deployment string
+	job        string
+	allocs     map[string]*allocState
+	wait       time.Duration
+	index      uint64
+}
+
+// newEvalState creates and initializes a new monitorState
+func newEvalState() *evalState {
+	return &evalState{
+		status: "pending",
+		allocs: make(map[string]*allocState),
+	}
+}
+
+// allocState is used to track the state of an allocation
+type allocState struct {
+	id          string
+	eval        string
+	group       string
+	node        string
+	desired     string
+	desiredDesc string
+	client      string
+	clientDesc  string
+	index       uint64
+	tasks       map[string]*api.TaskState
+}
+
+// Monitor follows evaluations and deployments, passing the changes it
+// sees to its handlers.
+type Monitor struct {
+	// EventStream makes the monitor follow changes with the Nomad event
+	// stream, falling back to blocking queries when the stream cannot be
+	// used.
+	EventStream bool
+
+	// LogLines is the number of lines of stderr shown for failed tasks,
+	// none if zero.
+	LogLines int
+
+	client   Client
+	handlers []Handler
+	state    *evalState
+
+	// emitLock serializes the handlers, allocations and deployments being
+	// followed concurrently.
+	emitLock sync.Mutex
+
+	sync.Mutex
+}
+
+// New returns a new Monitor reporting events to the given handlers.
+func New(client Client, handlers ...Handler) *Monitor {
+	return &Monitor{
+		client:   client,
+		handlers: handlers,
+		state:    newEvalState(),
+	}
+}
+
+// emit passes e to every handler.
+func (m *Monitor) emit(e *Event) {
+	m.emitLock.Lock()
+	defer m.emitLock.Unlock()
+
+	e.Time = time.Now().UTC()
+	for _, h := range m.handlers {
+		h(e)
+	}
+}
+
+// update is used to update our monitor with new state. It can be
+// called whether the passed information is new or not, and will
+// only emit events when state changes.
+func (m *Monitor) update(ctx context.Context, update *evalState) {
+	m.Lock()
+	defer m.Unlock()
+
+	existing := m.state
+
+	// Swap in the new state at the end
+	defer func() {
+		m.state = update
+	}()
+
+	// Check the allocations
+	for allocID, alloc := range update.allocs {
+		if existing, ok := existing.allocs[allocID]; !ok {
+			switch {
+			case alloc.index < update.index:
+				// New alloc with create index lower than the eval
+				// create index indicates modification
+				m.emit(&Event{
+					Type:    EventAllocModified,
+					EvalID:  alloc.eval,
+					AllocID: alloc.id,
+					Node:    alloc.node,
+					Group:   alloc.group,
+				})
+
+			case alloc.desired == "run":
+				// New allocation with desired status running
+				m.emit(&Event{
+					Type:    EventAllocCreated,
+					EvalID:  alloc.eval,
+					AllocID: alloc.id,
+					Node:    alloc.node,
+					Group:   alloc.group,
+				})
+			}
+		} else {
+			switch {
+			case existing.client != alloc.client:
+				// Allocation status has changed
+				m.emit(&Event{
+					Type:        EventAllocStatus,
+					EvalID:      alloc.eval,
+					AllocID:     alloc.id,
+					Node:        alloc.node,
+					Group:       alloc.group,
+					Status:      alloc.client,
+					PrevStatus:  existing.client,
+					Description: alloc.clientDesc,
+				})
+			}
+		}
+		m.taskUpdates(ctx, existing.allocs[allocID], alloc)
+	}
+
+	// Check if the status changed. We skip any transitions to pending status.
+	if existing.status != "" &&
+		update.status != "pending" &&
+		existing.status != update.status {
+		m.emit(&Event{
+			Type:       EventEvalStatus,
+			EvalID:     update.id,
+			Status:     update.status,
+			PrevStatus: existing.status,
+		})
+	}
+}
+
+// nextIndex returns the index to block on after a query answered at
+// lastIndex, starting over if the index went backwards.
+func nextIndex(index, lastIndex uint64) uint64 {
+	if lastIndex < index {
+		return 0
+	}
+	return lastIndex
+}
+
+// wait pauses between two polls, returning early with the context error
+// once ctx is done.
+func wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(updateWait):
+		return nil
+	}
+}
+
+// Eval monitors the given evaluation until it completes and returns it.
+// An error is returned if the evaluation failed to place all allocations,
+// or if ctx is done first, describing where the evaluation was at.
+func (m *Monitor) Eval(ctx context.Context, evalID string) (*api.Evaluation, error) {
+	// Add the initial pending state
+	m.update(ctx, newEvalState())
+	m.emit(&Event{Type: EventEvalMonitor, EvalID: evalID})
+
+	if m.EventStream {
+		eval, err, fallback := m.streamEval(ctx, evalID)
+		if fallback == nil {
+			return eval, err
+		}
+		m.emit(&Event{
+			Type:        EventStreamFallback,
+			EvalID:      evalID,
+			Description: fallback.Error(),
+		})
+	}
+
+	// The evaluation is queried blocking until it changes, its allocations
+	// being placed before it completes.
+	q := (&api.QueryOptions{WaitTime: blockingWait}).WithContext(ctx)
+	var index uint64
+	for {
+		// Query the evaluation
+		q.WaitIndex = index
+		eval, meta, err := m.client.Evaluation(evalID, q)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, m.evalGiveUp(evalID, ctx.Err())
+			}
+			return nil, fmt.Errorf("No evaluation with id %q found", evalID)
+		}
+
+		state, err := m.evalState(ctx, eval)
+		if err != nil {
+			return nil, err
+		}
+
+		// Update the state
+		m.update(ctx, state)
+
+		if evalDone(eval) {
+			return m.evalComplete(eval)
+		}
+
+		// Wait for the next update
+		index = nextIndex(index, meta.LastIndex)
+		if index == 0 {
+			if err := wait(ctx); err != nil {
+				return nil, m.evalGiveUp(evalID, err)
+			}
+		}
+	}
+}
+
+// evalDone reports whether the evaluation reached a terminal status.
+func evalDone(eval *api.Evaluation) bool {
+	switch eval.Status {
+	case "complete", "failed", "cancelled":
+		return true
+	}
+	return false
+}
+
+// evalState returns the state of eval, querying its allocations.
+func (m *Monitor) evalState(ctx context.Context, eval *api.Evaluation) (*evalState, error) {
+	// Create the new eval state.
+	state := newEvalState()
+	setEval(state, eval)
+
+	// Query the allocations associated with the evaluation
+	allocs, _, err := m.client.EvaluationAllocations(eval.ID, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, m.evalGiveUp(eval.ID, ctx.Err())
+		}
+		return nil, fmt.Errorf("Error reading allocations: %s", err)
+	}
+
+	// Add the allocs to the state
+	for _, alloc := range allocs {
+		setAlloc(state, alloc)
+	}
+	return state, nil
+}
+
+// setEval records eval in state.
+func setEval(state *evalState, eval *api.Evaluation) {
+	state.id = eval.ID
+	state.status = eval.Status
+	state.desc = eval.StatusDescription
+	state.node = eval.NodeID
+	state.job = eval.JobID
+	state.deployment = eval.DeploymentID
+	state.wait = eval.Wait
+	state.index = eval.CreateIndex
+}
+
+// setAlloc records alloc in state.
+func setAlloc(state *evalState, alloc *api.AllocationListStub) {
+	state.allocs[alloc.ID] = &allocState{
+		id:          alloc.ID,
+		eval:        alloc.EvalID,
+		group:       alloc.TaskGroup,
+		node:        alloc.NodeID,
+		desired:     alloc.DesiredStatus,
+		desiredDesc: alloc.DesiredDescription,
+		client:      alloc.ClientStatus,
+		clientDesc:  alloc.ClientDescription,
+		index:       alloc.CreateIndex,
+		tasks:       alloc.TaskStates,
+	}
+}
+
+// evalComplete reports the completion of eval, returning an error if it
+// failed to place all allocations or did not complete.
+func (m *Monitor) evalComplete(eval *api.Evaluation) (*api.Evaluation, error) {
+	m.emit(&Event{
+		Type:        EventEvalComplete,
+		EvalID:      eval.ID,
+		Status:      eval.Status,
+		Description: eval.StatusDescription,
+		Failed:      len(eval.FailedTGAllocs),
+	})
+	if len(eval.FailedTGAllocs) == 0 {
+		if eval.Status != "complete" {
+			return eval, fmt.Errorf("Evaluation %q %s: %s",
+				eval.ID, eval.Status, eval.StatusDescription)
+		}
+		return eval, nil
+	}
+
+	// There were failures making the allocations, report them per
+	// task group
+	for tg, metrics := range eval.FailedTGAllocs {
+		m.emit(&Event{
+			Type:    EventPlacementFailure,
+			EvalID:  eval.ID,
+			Group:   tg,
+			Failed:  metrics.CoalescedFailures + 1,
+			Metrics: metrics,
+		})
+	}
+	if eval.BlockedEval != "" {
+		m.emit(&Event{Type: EventEvalBlocked, EvalID: eval.BlockedEval})
+	}
+	return eval, fmt.Errorf("Failed to schedule all allocations")
+}
+
+// evalGiveUp returns the error of a monitor stopped by err before the
+// evaluation completed, with the last state seen.
+func (m *Monitor) evalGiveUp(evalID string, err error) error {
+	m.Lock()
+	defer m.Unlock()
+
+	state := m.state
+	msg := fmt.Sprintf("evaluation status %q", state.status)
+	if state.desc != "" {
+		msg += fmt.Sprintf(" (%s)", state.desc)
+	}
+
+	// Count the allocations per client status
+	counts := make(map[string]int)
+	for _, alloc := range state.allocs {
+		counts[alloc.client]++
+	}
+	if len(counts) == 0 {
+		msg += ", no allocations"
+	} else {
+		var statuses []string
+		for status, n := range counts {
+			statuses = append(statuses, fmt.Sprintf("%d %s", n, status))
+		}
+		sort.Strings(statuses)
+		msg += ", allocations: " + strings.Join(statuses, ", ")
+	}
+
+	return fmt.Errorf("Gave up monitoring evaluation %q: %s; %s", evalID, err, msg)
+}
+
+// Deployment monitors the given deployment until it finishes and returns
+// an error unless it was successful, or if ctx is done first.
+func (m *Monitor) Deployment(ctx context.Context, deployID string) error {
+	m.emit(&Event{Type: EventDeploymentMonitor, DeploymentID: deployID})
+
+	var last *api.Deployment
+	if m.EventStream {
+		err, fallback := m.streamDeployment(ctx, deployID, &last)
+		if fallback == nil {
+			return err
+		}
+		m.emit(&Event{
+			Type:         EventStreamFallback,
+			DeploymentID: deployID,
+			Description:  fallback.Error(),
+		})
+	}
+
+	// Task restarts and client status changes leave the deployment
+	// untouched, so its allocations are followed on their own index until
+	// the deployment is done.
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watchErr := make(chan error, 1)
+	go func() {
+		err := m.watchDeploymentAllocs(ctx, watchCtx, deployID)
+		cancel()
+		watchErr <- err
+	}()
+	stop := func() error {
+		cancel()
+		return <-watchErr
+	}
+	giveUp := func(err error) error {
+		if werr := stop(); werr != nil {
+			return werr
+		}
+		if ctx.Err() != nil {
+			return deploymentGiveUp(deployID, last, ctx.Err())
+		}
+		return err
+	}
+
+	q := (&api.QueryOptions{WaitTime: blockingWait}).WithContext(watchCtx)
+	var index uint64
+	for {
+		q.WaitIndex = index
+		deploy, meta, err := m.client.Deployment(deployID, q)
+		if err != nil {
+			return giveUp(fmt.Errorf("No deployment with id %q found", deployID))
+		}
+
+		if deploymentDone(deploy) {
+			// Report the final state of the allocations before the
+			// outcome.
+			if err := stop(); err != nil {
+				return err
+			}
+			if err := m.deploymentAllocs(ctx, deploy, last); err != nil {
+				return err
+			}
+		}
+		if done, err := m.deploymentUpdate(&last, deploy); done {
+			return err
+		}
+
+		// Wait for the next update
+		index = nextIndex(index, meta.LastIndex)
+		if index == 0 {
+			if err := wait(watchCtx); err != nil {
+				return giveUp(err)
+			}
+		}
+	}
+}
+
+// watchDeploymentAllocs follows the allocations of the deployment,
+// reporting their changes, until watchCtx is done. The task logs are read
+// with ctx, so that stopping the watch doesn't cut them.
+func (m *Monitor) watchDeploymentAllocs(ctx, watchCtx context.Context, deployID string) error {
+	q := (&api.QueryOptions{WaitTime: blockingWait}).WithContext(watchCtx)
+	var index uint64
+	for {
+		q.WaitIndex = index
+		allocs, meta, err := m.client.DeploymentAllocations(deployID, q)
+		if err != nil {
+			if watchCtx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("Error reading allocations: %s", err)
+		}
+
+		state := m.copyState()
+		for _, alloc := range allocs {
+			setAlloc(state, alloc)
+		}
+		m.update(ctx, state)
+
+		// Wait for the next update
+		index = nextIndex(index, meta.LastIndex)
+		if index == 0 {
+			if wait(watchCtx) != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// deploymentAllocs updates the state with the allocations of deploy,
+// reporting their changes.
+func (m *Monitor) deploymentAllocs(ctx context.Context, deploy, last *api.Deployment) error {
+	allocs, _, err := m.client.DeploymentAllocations(deploy.ID, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return deploymentGiveUp(deploy.ID, last, ctx.Err())
+		}
+		return fmt.Errorf("Error reading allocations: %s", err)
+	}
+
+	state := m.copyState()
+	for _, alloc := range allocs {
+		setAlloc(state, alloc)
+	}
+	m.update(ctx, state)
+	return nil
+}
+
+// deploymentUpdate reports the changes of deploy since last, which it
+// updates, and whether the deployment is done, with an error unless it
+// was successful.
+func (m *Monitor) deploymentUpdate(last **api.Deployment, deploy *api.Deployment) (bool, error) {
+	if *last == nil || deploy.Status != (*last).Status {
+		m.emit(&Event{
+			Type:         EventDeploymentStatus,
+			DeploymentID: deploy.ID,
+			Status:       deploy.Status,
+			Description:  deploy.StatusDescription,
+		})
+	}
+	*last = deploy
+
+	if !deploymentDone(deploy) {
+		return false, nil
+	}
+	if deploy.Status != "successful" {
+		return true, fmt.Errorf("Deployment %q %s: %s",
+			deploy.ID, deploy.Status, deploy.StatusDescription)
+	}
+	return true, nil
+}
+
+// deploymentDone reports whether the deployment reached a terminal status.
+func deploymentDone(deploy *api.Deployment) bool {
+	switch deploy.Status {
+	case "successful", "failed", "cancelled":
+		return true
+	}
+	return false
+}
+
+// deploymentGiveUp returns the error of a monitor stopped by err before
+// the deployment finished, with the progress of each task group.
+func deploymentGiveUp(deployID string, deploy *api.Deployment, err error) error {
+	if deploy == nil {
+		return fmt.Errorf("Gave up monitoring deployment %q: %s", deployID, err)
+	}
+
+	msg := fmt.Sprintf("deployment status %q", deploy.Status)
+	if deploy.StatusDescription != "" {
+		msg += fmt.Sprintf(" (%s)", deploy.StatusDescription)
+	}
+
+	groups := make([]string, 0, len(deploy.TaskGroups))
+	for tg := range deploy.TaskGroups {
+		groups = append(groups, tg)
+	}
+	sort.Strings(groups)
+	for _, tg := range groups {
+		state := deploy.TaskGroups[tg]
+		msg += fmt.Sprintf(", group %q: %d/%d placed, %d healthy, %d unhealthy",
+			tg, state.PlacedAllocs, state.DesiredTotal, state.HealthyAllocs, state.UnhealthyAllocs)
+	}
+
+	return fmt.Errorf("Gave up monitoring deployment %q: %s; %s", deployID, err, msg)
+}
+
+// AllocsStopped follows the allocations of the job until none of them is
+// pending or running, returning an error if ctx is done first.
+func (m *Monitor) AllocsStopped(ctx context.Context, jobID string) error {
+	q := (&api.QueryOptions{WaitTime: blockingWait}).WithContext(ctx)
+	var index uint64
+	first := true
+	for {
+		q.WaitIndex = index
+		allocs, meta, err := m.client.JobAllocations(jobID, false, q)
+		if err != nil {
+			if ctx.Err() != nil {
+				return m.allocsGiveUp(jobID, ctx.Err())
+			}
+			return fmt.Errorf("Error reading allocations: %s", err)
+		}
+
+		if first {
+			m.seed(allocs)
+			first = false
+		}
+		state := m.copyState()
+		for _, alloc := range allocs {
+			setAlloc(state, alloc)
+		}
+		m.update(ctx, state)
+
+		if running(allocs) == 0 {
+			return nil
+		}
+
+		// Wait for the next update
+		index = nextIndex(index, meta.LastIndex)
+		if index == 0 {
+			if err := wait(ctx); err != nil {
+				return m.allocsGiveUp(jobID, err)
+			}
+		}
+	}
+}
+
+// seed adds the allocations not monitored yet to the state as they are,
+// only their later changes being reported.
+func (m *Monitor) seed(allocs []*api.AllocationListStub) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, alloc := range allocs {
+		if _, ok := m.state.allocs[alloc.ID]; !ok {
+			setAlloc(m.state, alloc)
+		}
+	}
+}
+
+// running counts the allocations that are pending or running.
+func running(allocs []*api.AllocationListStub) int {
+	n := 0
+	for _, alloc := range allocs {
+		switch alloc.ClientStatus {
+		case "pending", "running":
+			n++
+		}
+	}
+	return n
+}
+
+// allocsGiveUp returns the error of a monitor stopped by err before the
+// allocations of the job stopped.
+func (m *Monitor) allocsGiveUp(jobID string, err error) error {
+	m.Lock()
+	defer m.Unlock()
+
+	var ids []string
+	for _, alloc := range m.state.allocs {
+		switch alloc.client {
+		case "pending", "running":
+			ids = append(ids, alloc.id)
+		}
+	}
+	sort.Strings(ids)
+	return fmt.Errorf("Gave up waiting for the allocations of job %q to stop: %s; still running: %s",
+		jobID, err, strings.Join(ids, ", "))
+}
@@ -0,0 +1,414 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// fakeClient serves sequences of states, the i-th state of a sequence
+// being at index i+1. Blocking queries get the state after the index they
+// wait on, or block until their context is done past the last one, while
+// other queries get the last state.
+type fakeClient struct {
+	evals        []*api.Evaluation
+	evalAllocs   []*api.AllocationListStub
+	deploys      []*api.Deployment
+	deployAllocs [][]*api.AllocationListStub
+	jobAllocs    [][]*api.AllocationListStub
+	stderr       string
+}
+
+// fakeNext returns the position in a sequence of n states of the state to
+// answer q with.
+func fakeNext(q *api.QueryOptions, n int) (int, error) {
+	if n == 0 {
+		return 0, fmt.Errorf("not found")
+	}
+	if q.WaitTime == 0 {
+		return n - 1, nil
+	}
+	if int(q.WaitIndex) < n {
+		return int(q.WaitIndex), nil
+	}
+	<-q.Context().Done()
+	return 0, q.Context().Err()
+}
+
+func (c *fakeClient) Evaluation(evalID string, q *api.QueryOptions) (*api.Evaluation, *api.QueryMeta, error) {
+	i, err := fakeNext(q, len(c.evals))
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.evals[i], &api.QueryMeta{LastIndex: uint64(i + 1)}, nil
+}
+
+func (c *fakeClient) EvaluationAllocations(evalID string, q *api.QueryOptions) ([]*api.AllocationListStub, *api.QueryMeta, error) {
+	return c.evalAllocs, &api.QueryMeta{LastIndex: 1}, nil
+}
+
+func (c *fakeClient) Deployment(deployID string, q *api.QueryOptions) (*api.Deployment, *api.QueryMeta, error) {
+	i, err := fakeNext(q, len(c.deploys))
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.deploys[i], &api.QueryMeta{LastIndex: uint64(i + 1)}, nil
+}
+
+func (c *fakeClient) DeploymentAllocations(deployID string, q *api.QueryOptions) ([]*api.AllocationListStub, *api.QueryMeta, error) {
+	i, err := fakeNext(q, len(c.deployAllocs))
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.deployAllocs[i], &api.QueryMeta{LastIndex: uint64(i + 1)}, nil
+}
+
+func (c *fakeClient) Allocation(allocID string, q *api.QueryOptions) (*api.Allocation, *api.QueryMeta, error) {
+	return &api.Allocation{ID: allocID}, &api.QueryMeta{}, nil
+}
+
+func (c *fakeClient) JobAllocations(jobID string, all bool, q *api.QueryOptions) ([]*api.AllocationListStub, *api.QueryMeta, error) {
+	i, err := fakeNext(q, len(c.jobAllocs))
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.jobAllocs[i], &api.QueryMeta{LastIndex: uint64(i + 1)}, nil
+}
+
+func (c *fakeClient) Logs(alloc *api.Allocation, follow bool, task, logType, origin string, offset int64, cancel <-chan struct{}, q *api.QueryOptions) (<-chan *api.StreamFrame, <-chan error) {
+	frames := make(chan *api.StreamFrame, 1)
+	errs := make(chan error)
+	frames <- &api.StreamFrame{Data: []byte(c.stderr)}
+	close(frames)
+	close(errs)
+	return frames, errs
+}
+
+func (c *fakeClient) EventStream(ctx context.Context, topics map[api.Topic][]string, index uint64, q *api.QueryOptions) (<-chan *api.Events, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+// recorder collects the events of a monitor, optionally cancelling the
+// monitored context on the first event of a type.
+type recorder struct {
+	mu       sync.Mutex
+	events   []*Event
+	cancelOn EventType
+	cancel   context.CancelFunc
+}
+
+func (r *recorder) handle(e *Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+	if r.cancel != nil && e.Type == r.cancelOn {
+		r.cancel()
+	}
+}
+
+// of returns the recorded events of type t.
+func (r *recorder) of(t EventType) []*Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var result []*Event
+	for _, e := range r.events {
+		if e.Type == t {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func alloc(id, status string, tasks map[string]*api.TaskState) *api.AllocationListStub {
+	return &api.AllocationListStub{
+		ID:            id,
+		EvalID:        "e1",
+		TaskGroup:     "web",
+		NodeID:        "n1",
+		DesiredStatus: "run",
+		ClientStatus:  status,
+		CreateIndex:   10,
+		TaskStates:    tasks,
+	}
+}
+
+// check runs a monitor test, comparing the error and the number of events
+// of each type recorded.
+func check(t *testing.T, err error, wantErr string, r *recorder, want map[EventType]int) {
+	t.Helper()
+	switch {
+	case wantErr == "" && err != nil:
+		t.Fatalf("unexpected error: %s", err)
+	case wantErr != "" && err == nil:
+		t.Fatalf("expected error containing %q", wantErr)
+	case wantErr != "" && !strings.Contains(err.Error(), wantErr):
+		t.Fatalf("expected error containing %q, got %q", wantErr, err)
+	}
+	for typ, n := range want {
+		if got := len(r.of(typ)); got != n {
+			t.Errorf("expected %d %s events, got %d", n, typ, got)
+		}
+	}
+}
+
+func TestEval(t *testing.T) {
+	cases := []struct {
+		name    string
+		client  *fakeClient
+		timeout time.Duration
+		wantErr string
+		want    map[EventType]int
+	}{
+		{
+			name: "complete",
+			client: &fakeClient{
+				evals: []*api.Evaluation{
+					{ID: "e1", Status: "pending", CreateIndex: 5},
+					{ID: "e1", Status: "complete", CreateIndex: 5},
+				},
+				evalAllocs: []*api.AllocationListStub{alloc("a1", "pending", nil)},
+			},
+			want: map[EventType]int{
+				EventEvalMonitor:      1,
+				EventAllocCreated:     1,
+				EventEvalStatus:       1,
+				EventEvalComplete:     1,
+				EventPlacementFailure: 0,
+			},
+		},
+		{
+			name: "placement failure",
+			client: &fakeClient{
+				evals: []*api.Evaluation{{
+					ID:          "e1",
+					Status:      "complete",
+					BlockedEval: "e2",
+					FailedTGAllocs: map[string]*api.AllocationMetric{
+						"web": {NodesEvaluated: 2, NodesExhausted: 2, CoalescedFailures: 1},
+					},
+				}},
+			},
+			wantErr: "Failed to schedule all allocations",
+			want: map[EventType]int{
+				EventEvalComplete:     1,
+				EventPlacementFailure: 1,
+				EventEvalBlocked:      1,
+			},
+		},
+		{
+			name: "failed",
+			client: &fakeClient{
+				evals: []*api.Evaluation{
+					{ID: "e1", Status: "failed", StatusDescription: "maximum attempts reached (5)"},
+				},
+			},
+			wantErr: `Evaluation "e1" failed: maximum attempts reached (5)`,
+			want: map[EventType]int{
+				EventEvalComplete:     1,
+				EventPlacementFailure: 0,
+			},
+		},
+		{
+			name: "context done",
+			client: &fakeClient{
+				evals: []*api.Evaluation{
+					{ID: "e1", Status: "pending", StatusDescription: "waiting"},
+				},
+				evalAllocs: []*api.AllocationListStub{
+					alloc("a1", "pending", nil),
+					alloc("a2", "running", nil),
+				},
+			},
+			timeout: 50 * time.Millisecond,
+			wantErr: `Gave up monitoring evaluation "e1": context deadline exceeded; ` +
+				`evaluation status "pending" (waiting), allocations: 1 pending, 1 running`,
+			want: map[EventType]int{
+				EventAllocCreated: 2,
+				EventEvalComplete: 0,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+				defer cancel()
+			}
+
+			r := &recorder{}
+			_, err := New(tc.client, r.handle).Eval(ctx, "e1")
+			check(t, err, tc.wantErr, r, tc.want)
+		})
+	}
+}
+
+func TestEvalPlacementFailureEvent(t *testing.T) {
+	metrics := &api.AllocationMetric{NodesEvaluated: 2, NodesExhausted: 2}
+	client := &fakeClient{
+		evals: []*api.Evaluation{{
+			ID:             "e1",
+			Status:         "complete",
+			FailedTGAllocs: map[string]*api.AllocationMetric{"web": metrics},
+		}},
+	}
+
+	r := &recorder{}
+	eval, err := New(client, r.handle).Eval(context.Background(), "e1")
+	if err == nil || eval == nil {
+		t.Fatalf("expected the failed evaluation and an error, got %v, %v", eval, err)
+	}
+	failures := r.of(EventPlacementFailure)
+	if len(failures) != 1 {
+		t.Fatalf("expected 1 placement failure, got %d", len(failures))
+	}
+	if e := failures[0]; e.Group != "web" || e.Failed != 1 || e.Metrics != metrics {
+		t.Errorf("unexpected placement failure event: %+v", e)
+	}
+}
+
+func TestDeployment(t *testing.T) {
+	failed := map[string]*api.TaskState{
+		"app": {State: "dead", Failed: true, Restarts: 2},
+	}
+	restarted := map[string]*api.TaskState{
+		"app": {State: "running", Restarts: 1},
+	}
+
+	cases := []struct {
+		name     string
+		client   *fakeClient
+		cancelOn EventType
+		wantErr  string
+		want     map[EventType]int
+		logs     string
+	}{
+		{
+			name: "successful",
+			client: &fakeClient{
+				deploys: []*api.Deployment{
+					{ID: "d1", Status: "running"},
+					{ID: "d1", Status: "successful"},
+				},
+				deployAllocs: [][]*api.AllocationListStub{
+					{alloc("a1", "running", nil)},
+				},
+			},
+			want: map[EventType]int{
+				EventDeploymentMonitor: 1,
+				EventDeploymentStatus:  2,
+				EventAllocCreated:      1,
+				EventTaskFailed:        0,
+			},
+		},
+		{
+			name: "failed",
+			client: &fakeClient{
+				deploys: []*api.Deployment{
+					{ID: "d1", Status: "running"},
+					{ID: "d1", Status: "failed", StatusDescription: "Failed due to unhealthy allocations"},
+				},
+				deployAllocs: [][]*api.AllocationListStub{
+					{alloc("a1", "running", nil)},
+					{alloc("a1", "failed", failed)},
+				},
+				stderr: "one\ntwo\nthree\n",
+			},
+			wantErr: `Deployment "d1" failed: Failed due to unhealthy allocations`,
+			want: map[EventType]int{
+				EventDeploymentStatus: 2,
+				EventTaskFailed:       1,
+			},
+			logs: "two\nthree",
+		},
+		{
+			// The deployment doesn't change while a task restarts, which
+			// must be reported nonetheless.
+			name: "task restarted",
+			client: &fakeClient{
+				deploys: []*api.Deployment{
+					{ID: "d1", Status: "running", TaskGroups: map[string]*api.DeploymentState{
+						"web": {DesiredTotal: 1, PlacedAllocs: 1},
+					}},
+				},
+				deployAllocs: [][]*api.AllocationListStub{
+					{alloc("a1", "running", map[string]*api.TaskState{"app": {State: "running"}})},
+					{alloc("a1", "running", restarted)},
+				},
+			},
+			cancelOn: EventTaskRestarted,
+			wantErr: `Gave up monitoring deployment "d1": context canceled; ` +
+				`deployment status "running", group "web": 1/1 placed, 0 healthy, 0 unhealthy`,
+			want: map[EventType]int{
+				EventTaskRestarted: 1,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			r := &recorder{cancelOn: tc.cancelOn, cancel: cancel}
+			m := New(tc.client, r.handle)
+			m.LogLines = 2
+			err := m.Deployment(ctx, "d1")
+			check(t, err, tc.wantErr, r, tc.want)
+
+			if tc.logs != "" {
+				if e := r.of(EventTaskFailed); len(e) == 1 && e[0].Logs != tc.logs {
+					t.Errorf("expected stderr %q, got %q", tc.logs, e[0].Logs)
+				}
+			}
+		})
+	}
+}
+
+func TestAllocsStopped(t *testing.T) {
+	cases := []struct {
+		name    string
+		allocs  [][]*api.AllocationListStub
+		wantErr string
+		want    map[EventType]int
+	}{
+		{
+			name: "stopped",
+			allocs: [][]*api.AllocationListStub{
+				{alloc("a1", "running", nil), alloc("a2", "complete", nil)},
+				{alloc("a1", "complete", nil), alloc("a2", "complete", nil)},
+			},
+			want: map[EventType]int{
+				// Only the changes after the first read are reported.
+				EventAllocCreated: 0,
+				EventAllocStatus:  1,
+			},
+		},
+		{
+			name: "still running",
+			allocs: [][]*api.AllocationListStub{
+				{alloc("a2", "running", nil), alloc("a1", "pending", nil), alloc("a3", "failed", nil)},
+			},
+			wantErr: `Gave up waiting for the allocations of job "web" to stop: ` +
+				`context deadline exceeded; still running: a1, a2`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			r := &recorder{}
+			err := New(&fakeClient{jobAllocs: tc.allocs}, r.handle).AllocsStopped(ctx, "web")
+			check(t, err, tc.wantErr, r, tc.want)
+		})
+	}
+}
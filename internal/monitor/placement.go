@@ -0,0 +1,242 @@
+package monitor
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/api"
+	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
+)
+
+// maxScores is the number of best scored nodes reported.
+const maxScores = 3
+
+// Kinds of PlacementReason.
+const (
+	ReasonEligibility        = "eligibility"
+	ReasonDatacenter         = "datacenter"
+	ReasonClassFiltered      = "class filtered"
+	ReasonConstraint         = "constraint"
+	ReasonExhausted          = "exhausted"
+	ReasonClassExhausted     = "class exhausted"
+	ReasonDimensionExhausted = "dimension exhausted"
+	ReasonQuota              = "quota"
+)
+
+// PlacementReason is one of the reasons allocations could not be placed,
+// Subject being the constraint, class, dimension, datacenter or quota
+// concerned and Nodes the number of nodes it applies to.
+type PlacementReason struct {
+	Kind    string
+	Subject string
+	Nodes   int
+}
+
+func (r PlacementReason) String() string {
+	switch r.Kind {
+	case ReasonEligibility:
+		return "No nodes were eligible for evaluation"
+	case ReasonDatacenter:
+		return fmt.Sprintf("No nodes are available in datacenter %q", r.Subject)
+	case ReasonClassFiltered:
+		return fmt.Sprintf("Class %q: %d nodes excluded by filter", r.Subject, r.Nodes)
+	case ReasonConstraint:
+		return fmt.Sprintf("Constraint %q: %d nodes excluded by filter", r.Subject, r.Nodes)
+	case ReasonExhausted:
+		return fmt.Sprintf("Resources exhausted on %d nodes", r.Nodes)
+	case ReasonClassExhausted:
+		return fmt.Sprintf("Class %q exhausted on %d nodes", r.Subject, r.Nodes)
+	case ReasonDimensionExhausted:
+		return fmt.Sprintf("Dimension %q exhausted on %d nodes", r.Subject, r.Nodes)
+	case ReasonQuota:
+		return fmt.Sprintf("Quota limit hit %q", r.Subject)
+	}
+	return r.Kind
+}
+
+// NodeScore is the score of a node considered for placement, Scores
+// holding the score of each scorer.
+type NodeScore struct {
+	NodeID string
+	Score  float64
+	Scores map[string]float64
+}
+
+// PlacementFailure describes why allocations of a task group could not be
+// placed.
+type PlacementFailure struct {
+	Group string
+
+	// Failed is the number of allocations not placed.
+	Failed int
+
+	// NodesEvaluated, NodesFiltered and NodesExhausted count the nodes
+	// considered, those filtered out and those lacking resources.
+	NodesEvaluated int
+	NodesFiltered  int
+	NodesExhausted int
+
+	Reasons []PlacementReason
+
+	// Scores are the best scored nodes, best first.
+	Scores []NodeScore
+
+	// Suggestions are hints at how to solve the failure.
+	Suggestions []string
+}
+
+// NewPlacementFailure builds the report of the failure to place the task
+// group from its allocation metrics, which may be nil if unknown.
+func NewPlacementFailure(group string, metrics *api.AllocationMetric) *PlacementFailure {
+	if metrics == nil {
+		return &PlacementFailure{Group: group, Failed: 1}
+	}
+
+	f := &PlacementFailure{
+		Group:          group,
+		Failed:         metrics.CoalescedFailures + 1,
+		NodesEvaluated: metrics.NodesEvaluated,
+		NodesFiltered:  metrics.NodesFiltered,
+		NodesExhausted: metrics.NodesExhausted,
+	}
+
+	// An eligibility problem
+	if metrics.NodesEvaluated == 0 {
+		f.Reasons = append(f.Reasons, PlacementReason{Kind: ReasonEligibility})
+	}
+
+	// Datacenters asked for that have no available nodes
+	noNodes := false
+	for _, dc := range sortedKeys(metrics.NodesAvailable) {
+		if metrics.NodesAvailable[dc] == 0 {
+			noNodes = true
+			f.Reasons = append(f.Reasons, PlacementReason{Kind: ReasonDatacenter, Subject: dc})
+			f.suggest(fmt.Sprintf("No nodes in datacenter %q, check the datacenters of the job", dc))
+		}
+	}
+	if metrics.NodesEvaluated == 0 && !noNodes {
+		f.suggest("No node was eligible, check that the nodes are ready and neither draining nor ineligible")
+	}
+
+	// Filters
+	for _, class := range sortedKeys(metrics.ClassFiltered) {
+		f.Reasons = append(f.Reasons, PlacementReason{
+			Kind: ReasonClassFiltered, Subject: class, Nodes: metrics.ClassFiltered[class]})
+	}
+	for _, cs := range sortedKeys(metrics.ConstraintFiltered) {
+		n := metrics.ConstraintFiltered[cs]
+		f.Reasons = append(f.Reasons, PlacementReason{Kind: ReasonConstraint, Subject: cs, Nodes: n})
+		f.suggest(fmt.Sprintf("Constraint %q excludes %d nodes, relax it or add matching nodes", cs, n))
+	}
+
+	// Exhaustion
+	if metrics.NodesExhausted > 0 {
+		f.Reasons = append(f.Reasons, PlacementReason{Kind: ReasonExhausted, Nodes: metrics.NodesExhausted})
+	}
+	for _, class := range sortedKeys(metrics.ClassExhausted) {
+		f.Reasons = append(f.Reasons, PlacementReason{
+			Kind: ReasonClassExhausted, Subject: class, Nodes: metrics.ClassExhausted[class]})
+	}
+	for _, dim := range sortedKeys(metrics.DimensionExhausted) {
+		n := metrics.DimensionExhausted[dim]
+		f.Reasons = append(f.Reasons, PlacementReason{Kind: ReasonDimensionExhausted, Subject: dim, Nodes: n})
+		f.suggest(fmt.Sprintf("Not enough %s on %d nodes, lower the resources of the task group or add capacity", dim, n))
+	}
+
+	// Quotas
+	for _, dim := range metrics.QuotaExhausted {
+		f.Reasons = append(f.Reasons, PlacementReason{Kind: ReasonQuota, Subject: dim})
+		f.suggest(fmt.Sprintf("Quota limit %q reached, raise the quota of the namespace", dim))
+	}
+
+	// Node scores, best first
+	for _, meta := range metrics.ScoreMetaData {
+		if meta == nil {
+			continue
+		}
+		f.Scores = append(f.Scores, NodeScore{
+			NodeID: meta.NodeID,
+			Score:  meta.NormScore,
+			Scores: meta.Scores,
+		})
+	}
+	sort.SliceStable(f.Scores, func(i, j int) bool {
+		return f.Scores[i].Score > f.Scores[j].Score
+	})
+
+	return f
+}
+
+// suggest adds a suggestion unless already made.
+func (f *PlacementFailure) suggest(s string) {
+	for _, existing := range f.Suggestions {
+		if existing == s {
+			return
+		}
+	}
+	f.Suggestions = append(f.Suggestions, s)
+}
+
+// Summary is the one line description of the failure.
+func (f *PlacementFailure) Summary() string {
+	noun := "allocation"
+	if f.Failed > 1 {
+		noun += "s"
+	}
+	return fmt.Sprintf("Task Group %q (failed to place %d %s)", f.Group, f.Failed, noun)
+}
+
+// ReasonTable returns the reasons of the failure as a table.
+func (f *PlacementFailure) ReasonTable() *terminal.Table {
+	tbl := terminal.NewTable("Reason", "Subject", "Nodes")
+	for _, r := range f.Reasons {
+		nodes := ""
+		if r.Nodes > 0 {
+			nodes = strconv.Itoa(r.Nodes)
+		}
+		tbl.Rich([]string{r.Kind, r.Subject, nodes}, nil)
+	}
+	return tbl
+}
+
+// ScoreTable returns the n best scored nodes as a table.
+func (f *PlacementFailure) ScoreTable(n int) *terminal.Table {
+	tbl := terminal.NewTable("Node", "Score", "Scorers")
+	for i, s := range f.Scores {
+		if i == n {
+			break
+		}
+		var scorers []string
+		for name, score := range s.Scores {
+			scorers = append(scorers, fmt.Sprintf("%s=%.3f", name, score))
+		}
+		sort.Strings(scorers)
+		tbl.Rich([]string{s.NodeID, fmt.Sprintf("%.3f", s.Score), strings.Join(scorers, " ")}, nil)
+	}
+	return tbl
+}
+
+// FormatAllocMetrics describes why allocations could not be placed, one
+// reason per line starting with prefix. The scores of the best nodes are
+// only shown as a table, see UIHandler.
+func FormatAllocMetrics(metrics *api.AllocationMetric, prefix string) string {
+	f := NewPlacementFailure("", metrics)
+
+	var lines []string
+	for _, r := range f.Reasons {
+		lines = append(lines, fmt.Sprintf("%s* %s", prefix, r))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,130 @@
+package monitor
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+func TestNewPlacementFailure(t *testing.T) {
+	cases := []struct {
+		name        string
+		metrics     *api.AllocationMetric
+		reasons     []PlacementReason
+		suggestions []string
+	}{
+		{
+			name: "no nodes in datacenter",
+			metrics: &api.AllocationMetric{
+				NodesAvailable: map[string]int{"dc2": 0, "dc1": 3},
+			},
+			reasons: []PlacementReason{
+				{Kind: ReasonEligibility},
+				{Kind: ReasonDatacenter, Subject: "dc2"},
+			},
+			suggestions: []string{
+				`No nodes in datacenter "dc2", check the datacenters of the job`,
+			},
+		},
+		{
+			name: "no eligible node",
+			metrics: &api.AllocationMetric{
+				NodesAvailable: map[string]int{"dc1": 3},
+			},
+			reasons: []PlacementReason{
+				{Kind: ReasonEligibility},
+			},
+			suggestions: []string{
+				"No node was eligible, check that the nodes are ready and neither draining nor ineligible",
+			},
+		},
+		{
+			name: "filtered",
+			metrics: &api.AllocationMetric{
+				NodesEvaluated:     3,
+				NodesFiltered:      3,
+				ClassFiltered:      map[string]int{"gpu": 1},
+				ConstraintFiltered: map[string]int{"${attr.kernel.name} = windows": 2},
+			},
+			reasons: []PlacementReason{
+				{Kind: ReasonClassFiltered, Subject: "gpu", Nodes: 1},
+				{Kind: ReasonConstraint, Subject: "${attr.kernel.name} = windows", Nodes: 2},
+			},
+			suggestions: []string{
+				`Constraint "${attr.kernel.name} = windows" excludes 2 nodes, relax it or add matching nodes`,
+			},
+		},
+		{
+			name: "exhausted",
+			metrics: &api.AllocationMetric{
+				NodesEvaluated:     2,
+				NodesExhausted:     2,
+				ClassExhausted:     map[string]int{"default": 2},
+				DimensionExhausted: map[string]int{"memory": 2, "cpu": 1},
+				QuotaExhausted:     []string{"memory"},
+			},
+			reasons: []PlacementReason{
+				{Kind: ReasonExhausted, Nodes: 2},
+				{Kind: ReasonClassExhausted, Subject: "default", Nodes: 2},
+				{Kind: ReasonDimensionExhausted, Subject: "cpu", Nodes: 1},
+				{Kind: ReasonDimensionExhausted, Subject: "memory", Nodes: 2},
+				{Kind: ReasonQuota, Subject: "memory"},
+			},
+			suggestions: []string{
+				"Not enough cpu on 1 nodes, lower the resources of the task group or add capacity",
+				"Not enough memory on 2 nodes, lower the resources of the task group or add capacity",
+				`Quota limit "memory" reached, raise the quota of the namespace`,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := NewPlacementFailure("web", tc.metrics)
+			if !reflect.DeepEqual(f.Reasons, tc.reasons) {
+				t.Errorf("expected reasons %v, got %v", tc.reasons, f.Reasons)
+			}
+			if !reflect.DeepEqual(f.Suggestions, tc.suggestions) {
+				t.Errorf("expected suggestions %q, got %q", tc.suggestions, f.Suggestions)
+			}
+		})
+	}
+}
+
+func TestPlacementFailureScores(t *testing.T) {
+	f := NewPlacementFailure("web", &api.AllocationMetric{
+		NodesEvaluated:    3,
+		NodesExhausted:    3,
+		CoalescedFailures: 2,
+		ScoreMetaData: []*api.NodeScoreMeta{
+			{NodeID: "n1", NormScore: 0.2},
+			nil,
+			{NodeID: "n2", NormScore: 0.9},
+			{NodeID: "n3", NormScore: 0.5},
+		},
+	})
+
+	var nodes []string
+	for _, s := range f.Scores {
+		nodes = append(nodes, s.NodeID)
+	}
+	if want := []string{"n2", "n3", "n1"}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("expected nodes %v best first, got %v", want, nodes)
+	}
+	if want := `Task Group "web" (failed to place 3 allocations)`; f.Summary() != want {
+		t.Errorf("expected summary %q, got %q", want, f.Summary())
+	}
+}
+
+func TestPlacementFailureWithoutMetrics(t *testing.T) {
+	f := NewPlacementFailure("web", nil)
+	if len(f.Reasons) != 0 || len(f.Suggestions) != 0 || len(f.Scores) != 0 {
+		t.Errorf("expected an empty failure, got %+v", f)
+	}
+
+	e := &Event{Type: EventPlacementFailure, Group: "web", Failed: 1}
+	if want := `Task Group "web" (failed to place 1 allocation)`; e.Message() != want {
+		t.Errorf("expected message %q, got %q", want, e.Message())
+	}
+}
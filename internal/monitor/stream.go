@@ -0,0 +1,194 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// subscribe opens the event stream on topics filtered to jobID, from
+// index on.
+func (m *Monitor) subscribe(ctx context.Context, jobID string, index uint64, topics ...api.Topic) (<-chan *api.Events, error) {
+	filter := make(map[api.Topic][]string)
+	for _, topic := range topics {
+		filter[topic] = []string{jobID}
+	}
+	return m.client.EventStream(ctx, filter, index, (&api.QueryOptions{}).WithContext(ctx))
+}
+
+// next returns the next batch of events that is not a heartbeat.
+func next(ctx context.Context, events <-chan *api.Events) (*api.Events, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case batch, ok := <-events:
+			if !ok {
+				return nil, fmt.Errorf("event stream closed")
+			}
+			if batch.Err != nil {
+				return nil, batch.Err
+			}
+			if !batch.IsHeartbeat() {
+				return batch, nil
+			}
+		}
+	}
+}
+
+// copyState returns a copy of the current state, to be modified and
+// passed to update.
+func (m *Monitor) copyState() *evalState {
+	m.Lock()
+	defer m.Unlock()
+
+	state := *m.state
+	state.allocs = make(map[string]*allocState, len(m.state.allocs))
+	for id, alloc := range m.state.allocs {
+		state.allocs[id] = alloc
+	}
+	return &state
+}
+
+// streamEval monitors the evaluation with the Nomad event stream. A non
+// nil fallback error means the stream could not be used and the caller
+// should poll instead, picking up from the state reported so far.
+func (m *Monitor) streamEval(ctx context.Context, evalID string) (eval *api.Evaluation, err, fallback error) {
+	// Start from the current state of the evaluation, following its
+	// changes from the index it was read at.
+	eval, meta, err := m.client.Evaluation(evalID, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, m.evalGiveUp(evalID, ctx.Err()), nil
+		}
+		return nil, fmt.Errorf("No evaluation with id %q found", evalID), nil
+	}
+	state, err := m.evalState(ctx, eval)
+	if err != nil {
+		return nil, err, nil
+	}
+	m.update(ctx, state)
+	if evalDone(eval) {
+		eval, err = m.evalComplete(eval)
+		return eval, err, nil
+	}
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events, err := m.subscribe(streamCtx, eval.JobID, meta.LastIndex,
+		api.TopicEvaluation, api.TopicAllocation)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, m.evalGiveUp(evalID, ctx.Err()), nil
+		}
+		return nil, nil, err
+	}
+
+	for {
+		batch, err := next(ctx, events)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, m.evalGiveUp(evalID, ctx.Err()), nil
+			}
+			return nil, nil, err
+		}
+
+		state := m.copyState()
+		for _, event := range batch.Events {
+			switch event.Topic {
+			case api.TopicEvaluation:
+				e, err := event.Evaluation()
+				if err != nil || e == nil || e.ID != evalID {
+					continue
+				}
+				eval = e
+				setEval(state, e)
+
+			case api.TopicAllocation:
+				alloc, err := event.Allocation()
+				if err != nil || alloc == nil || alloc.EvalID != evalID {
+					continue
+				}
+				setAlloc(state, alloc.Stub())
+			}
+		}
+		m.update(ctx, state)
+
+		if evalDone(eval) {
+			eval, err = m.evalComplete(eval)
+			return eval, err, nil
+		}
+	}
+}
+
+// streamDeployment monitors the deployment with the Nomad event stream,
+// keeping last up to date. A non nil fallback error means the stream
+// could not be used and the caller should poll instead.
+func (m *Monitor) streamDeployment(ctx context.Context, deployID string, last **api.Deployment) (err, fallback error) {
+	deploy, meta, err := m.client.Deployment(deployID, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return deploymentGiveUp(deployID, *last, ctx.Err()), nil
+		}
+		return fmt.Errorf("No deployment with id %q found", deployID), nil
+	}
+	if err := m.deploymentAllocs(ctx, deploy, *last); err != nil {
+		return err, nil
+	}
+	if done, err := m.deploymentUpdate(last, deploy); done {
+		return err, nil
+	}
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events, err := m.subscribe(streamCtx, deploy.JobID, meta.LastIndex,
+		api.TopicDeployment, api.TopicAllocation)
+	if err != nil {
+		if ctx.Err() != nil {
+			return deploymentGiveUp(deployID, *last, ctx.Err()), nil
+		}
+		return nil, err
+	}
+
+	for {
+		batch, err := next(ctx, events)
+		if err != nil {
+			if ctx.Err() != nil {
+				return deploymentGiveUp(deployID, *last, ctx.Err()), nil
+			}
+			return nil, err
+		}
+
+		// Report the allocation changes first, the deployment failing
+		// because of them
+		state := m.copyState()
+		var deploys []*api.Deployment
+		for _, event := range batch.Events {
+			switch event.Topic {
+			case api.TopicDeployment:
+				d, err := event.Deployment()
+				if err != nil || d == nil || d.ID != deployID {
+					continue
+				}
+				deploys = append(deploys, d)
+
+			case api.TopicAllocation:
+				alloc, err := event.Allocation()
+				if err != nil || alloc == nil || alloc.DeploymentID != deployID {
+					continue
+				}
+				setAlloc(state, alloc.Stub())
+			}
+		}
+		m.update(ctx, state)
+
+		for _, d := range deploys {
+			if done, err := m.deploymentUpdate(last, d); done {
+				return err, nil
+			}
+		}
+	}
+}
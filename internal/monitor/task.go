@@ -0,0 +1,135 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+const (
+	// taskEventCount is the number of latest task events reported for a
+	// failed or restarted task.
+	taskEventCount = 3
+
+	// logBytesPerLine is the number of bytes of stderr read per line to
+	// show, the output being cut to the lines wanted.
+	logBytesPerLine = 512
+)
+
+// taskUpdates reports the tasks of alloc that failed or restarted since
+// the existing state of the allocation, if any.
+func (m *Monitor) taskUpdates(ctx context.Context, existing, alloc *allocState) {
+	names := make([]string, 0, len(alloc.tasks))
+	for name := range alloc.tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		task := alloc.tasks[name]
+		if task == nil {
+			continue
+		}
+		var prev *api.TaskState
+		if existing != nil {
+			prev = existing.tasks[name]
+		}
+
+		event := &Event{
+			EvalID:     alloc.eval,
+			AllocID:    alloc.id,
+			Node:       alloc.node,
+			Group:      alloc.group,
+			Task:       name,
+			Status:     task.State,
+			Restarts:   task.Restarts,
+			TaskEvents: taskEvents(task),
+		}
+		switch {
+		case task.Failed && (prev == nil || !prev.Failed):
+			event.Type = EventTaskFailed
+			if m.LogLines > 0 {
+				logs, err := m.stderr(ctx, alloc.id, name)
+				if err != nil {
+					logs = "error reading stderr: " + err.Error()
+				}
+				event.Logs = logs
+			}
+		case prev != nil && task.Restarts > prev.Restarts:
+			event.Type = EventTaskRestarted
+		default:
+			continue
+		}
+		m.emit(event)
+	}
+}
+
+// taskEvents describes the latest events of a task.
+func taskEvents(task *api.TaskState) []string {
+	events := task.Events
+	if len(events) > taskEventCount {
+		events = events[len(events)-taskEventCount:]
+	}
+
+	var result []string
+	for _, e := range events {
+		msg := e.DisplayMessage
+		if msg == "" {
+			msg = e.Message
+		}
+		if msg == "" {
+			result = append(result, e.Type)
+		} else {
+			result = append(result, e.Type+": "+msg)
+		}
+	}
+	return result
+}
+
+// stderr returns the last LogLines lines of the stderr of a task.
+func (m *Monitor) stderr(ctx context.Context, allocID, task string) (string, error) {
+	q := (&api.QueryOptions{}).WithContext(ctx)
+	alloc, _, err := m.client.Allocation(allocID, q)
+	if err != nil {
+		return "", err
+	}
+
+	cancel := make(chan struct{})
+	defer close(cancel)
+
+	offset := int64(m.LogLines) * logBytesPerLine
+	frames, errs := m.client.Logs(alloc, false, task, "stderr", "end", offset, cancel, q)
+
+	var buf bytes.Buffer
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case err := <-errs:
+			if err != nil {
+				return "", err
+			}
+			// Closed, wait for the frames to end
+			errs = nil
+		case frame, ok := <-frames:
+			if !ok {
+				return tail(buf.String(), m.LogLines), nil
+			}
+			if frame != nil {
+				buf.Write(frame.Data)
+			}
+		}
+	}
+}
+
+// tail returns the last n lines of s.
+func tail(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
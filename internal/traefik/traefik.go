@@ -0,0 +1,189 @@
+// Package traefik contains the helpers shared by the platform and release
+// components to route Nomad services through Traefik.
+package traefik
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// ReleaseRouterTag marks the services of a job that are routed by the
+// release manager, its value being the name of the Traefik router, e.g.
+// "waypoint.release-router=web".
+const ReleaseRouterTag = "waypoint.release-router"
+
+// RoutedService is a service of a job tagged with ReleaseRouterTag.
+type RoutedService struct {
+	JobService
+
+	// Router is the name of the Traefik router of the service.
+	Router string
+}
+
+// RoutedServices returns the services of job tagged with ReleaseRouterTag,
+// task group services first followed by those declared on tasks.
+func RoutedServices(job *api.Job) []RoutedService {
+	var result []RoutedService
+	for _, js := range Services(job) {
+		router := ""
+		for _, tag := range js.Service.Tags {
+			if strings.HasPrefix(tag, ReleaseRouterTag+"=") {
+				router = strings.TrimPrefix(tag, ReleaseRouterTag+"=")
+			}
+		}
+		if router != "" {
+			result = append(result, RoutedService{JobService: js, Router: router})
+		}
+	}
+	return result
+}
+
+// JobService is a service of a job with the task group and, for services
+// declared on tasks, the task it belongs to.
+type JobService struct {
+	Service *api.Service
+	Group   string
+
+	// Task is empty for task group services.
+	Task string
+}
+
+// Services returns the services of every task group of job, followed by
+// the services declared on their tasks.
+func Services(job *api.Job) []JobService {
+	var groups, tasks []JobService
+	for _, tg := range job.TaskGroups {
+		group := stringValue(tg.Name)
+		for _, svc := range tg.Services {
+			groups = append(groups, JobService{Service: svc, Group: group})
+		}
+		for _, task := range tg.Tasks {
+			for _, svc := range task.Services {
+				tasks = append(tasks, JobService{Service: svc, Group: group, Task: task.Name})
+			}
+		}
+	}
+	return append(groups, tasks...)
+}
+
+// ConsulServiceName returns the name the service is registered in Consul
+// with, resolving Nomad's default name and the interpolation of job, group
+// and task names. Other runtime variables can't be resolved.
+func ConsulServiceName(job *api.Job, js JobService) (string, error) {
+	jobName := stringValue(job.Name)
+	if jobName == "" {
+		jobName = stringValue(job.ID)
+	}
+
+	name := js.Service.Name
+	if name == "" {
+		name = "${BASE}"
+		if js.Task == "" {
+			name = "${JOB}-${TASKGROUP}"
+		}
+	}
+
+	name = strings.NewReplacer(
+		"${BASE}", strings.Join([]string{jobName, js.Group, js.Task}, "-"),
+		"${JOB}", jobName,
+		"${NOMAD_JOB_NAME}", jobName,
+		"${TASKGROUP}", js.Group,
+		"${NOMAD_GROUP_NAME}", js.Group,
+		"${TASK}", js.Task,
+		"${NOMAD_TASK_NAME}", js.Task,
+	).Replace(name)
+	if strings.Contains(name, "${") {
+		return "", fmt.Errorf("can't resolve the interpolation in service name %q", name)
+	}
+	return name, nil
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// HostRule returns a Traefik rule matching any of hosts and, if set,
+// requests below pathPrefix.
+func HostRule(hosts []string, pathPrefix string) (string, error) {
+	args, err := quoteHosts(hosts)
+	if err != nil {
+		return "", err
+	}
+	rule := fmt.Sprintf("Host(%s)", args)
+
+	if pathPrefix != "" {
+		if !strings.HasPrefix(pathPrefix, "/") {
+			return "", fmt.Errorf("path_prefix %q must start with a '/'", pathPrefix)
+		}
+		rule += fmt.Sprintf(" && PathPrefix(%s)", QuoteRuleValue(pathPrefix))
+	}
+	return rule, nil
+}
+
+// HostSNIRule returns a Traefik TCP rule matching TLS connections for any
+// of hosts.
+func HostSNIRule(hosts []string) (string, error) {
+	args, err := quoteHosts(hosts)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("HostSNI(%s)", args), nil
+}
+
+// quoteHosts validates hosts and returns them quoted as the arguments of a
+// Traefik rule matcher.
+func quoteHosts(hosts []string) (string, error) {
+	if len(hosts) == 0 {
+		return "", fmt.Errorf("at least one host is required")
+	}
+	args := make([]string, len(hosts))
+	for i, h := range hosts {
+		if h == "" || strings.ContainsAny(h, " \t\r\n/") {
+			return "", fmt.Errorf("invalid host %q", h)
+		}
+		args[i] = QuoteRuleValue(h)
+	}
+	return strings.Join(args, ", "), nil
+}
+
+// QuoteRuleValue quotes v as a string literal for a Traefik rule. Traefik
+// parses rule arguments as Go string literals, so raw backtick strings are
+// used unless v itself contains a backtick.
+func QuoteRuleValue(v string) string {
+	if strings.Contains(v, "`") {
+		return strconv.Quote(v)
+	}
+	return "`" + v + "`"
+}
+
+var (
+	// hostMatcherRe matches the Host and HostSNI matchers of a rule,
+	// capturing their arguments.
+	hostMatcherRe = regexp.MustCompile(`\b(?:Host|HostSNI)\(([^)]*)\)`)
+
+	// ruleValueRe matches a string literal argument of a rule matcher.
+	ruleValueRe = regexp.MustCompile("`[^`]*`|\"(?:[^\"\\\\]|\\\\.)*\"")
+)
+
+// RuleHosts returns the host names matched by the Host and HostSNI matchers
+// of rule, lower cased. Arguments that can't be parsed are skipped.
+func RuleHosts(rule string) []string {
+	var result []string
+	for _, m := range hostMatcherRe.FindAllStringSubmatch(rule, -1) {
+		for _, lit := range ruleValueRe.FindAllString(m[1], -1) {
+			v, err := strconv.Unquote(lit)
+			if err != nil || v == "" || v == "*" {
+				continue
+			}
+			result = append(result, strings.ToLower(v))
+		}
+	}
+	return result
+}
@@ -0,0 +1,156 @@
+package traefik
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHostRule(t *testing.T) {
+	cases := []struct {
+		name       string
+		hosts      []string
+		pathPrefix string
+		want       string
+		wantErr    string
+	}{
+		{
+			name:  "single host",
+			hosts: []string{"web.example.com"},
+			want:  "Host(`web.example.com`)",
+		},
+		{
+			name:  "multiple hosts",
+			hosts: []string{"web.example.com", "www.example.com"},
+			want:  "Host(`web.example.com`, `www.example.com`)",
+		},
+		{
+			name:       "path prefix",
+			hosts:      []string{"web.example.com"},
+			pathPrefix: "/api",
+			want:       "Host(`web.example.com`) && PathPrefix(`/api`)",
+		},
+		{
+			name:  "backtick in host",
+			hosts: []string{"we`b.example.com"},
+			want:  "Host(\"we`b.example.com\")",
+		},
+		{
+			name:       "backtick in path prefix",
+			hosts:      []string{"web.example.com"},
+			pathPrefix: "/a`b",
+			want:       "Host(`web.example.com`) && PathPrefix(\"/a`b\")",
+		},
+		{
+			name:       "relative path prefix",
+			hosts:      []string{"web.example.com"},
+			pathPrefix: "api",
+			wantErr:    `path_prefix "api" must start with a '/'`,
+		},
+		{
+			name:    "no hosts",
+			wantErr: "at least one host is required",
+		},
+		{
+			name:    "empty host",
+			hosts:   []string{"web.example.com", ""},
+			wantErr: `invalid host ""`,
+		},
+		{
+			name:    "host with space",
+			hosts:   []string{"web.example.com`) || Host(`evil.com"},
+			wantErr: "invalid host \"web.example.com`) || Host(`evil.com\"",
+		},
+		{
+			name:    "host with path",
+			hosts:   []string{"web.example.com/api"},
+			wantErr: `invalid host "web.example.com/api"`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := HostRule(tc.hosts, tc.pathPrefix)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %s", err)
+			case tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr):
+				t.Fatalf("expected error %q, got %v", tc.wantErr, err)
+			}
+			if got != tc.want {
+				t.Errorf("expected rule %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestHostSNIRule(t *testing.T) {
+	got, err := HostSNIRule([]string{"db.example.com", "db`.example.com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := "HostSNI(`db.example.com`, \"db`.example.com\")"; got != want {
+		t.Errorf("expected rule %q, got %q", want, got)
+	}
+
+	if _, err := HostSNIRule([]string{"db example.com"}); err == nil {
+		t.Errorf("expected an error for a host with a space")
+	}
+}
+
+func TestQuoteRuleValue(t *testing.T) {
+	cases := []struct {
+		value string
+		want  string
+	}{
+		{value: "web.example.com", want: "`web.example.com`"},
+		{value: `a"b\c`, want: "`a\"b\\c`"},
+		{value: "a`b", want: "\"a`b\""},
+		{value: "a`\"b", want: "\"a`\\\"b\""},
+	}
+
+	for _, tc := range cases {
+		if got := QuoteRuleValue(tc.value); got != tc.want {
+			t.Errorf("expected %q to be quoted as %q, got %q", tc.value, tc.want, got)
+		}
+	}
+}
+
+func TestRuleHosts(t *testing.T) {
+	cases := []struct {
+		name string
+		rule string
+		want []string
+	}{
+		{
+			name: "host",
+			rule: "Host(`Web.Example.com`, `www.example.com`) && PathPrefix(`/api`)",
+			want: []string{"web.example.com", "www.example.com"},
+		},
+		{
+			name: "double quoted",
+			rule: "Host(\"we`b.example.com\") || Host(`api.example.com`)",
+			want: []string{"we`b.example.com", "api.example.com"},
+		},
+		{
+			name: "host sni",
+			rule: "HostSNI(`db.example.com`)",
+			want: []string{"db.example.com"},
+		},
+		{
+			name: "wildcard",
+			rule: "HostSNI(`*`)",
+		},
+		{
+			name: "no host",
+			rule: "PathPrefix(`/api`)",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := RuleHosts(tc.rule); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected hosts %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
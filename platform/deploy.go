@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
 	"strings"
 	"time"
 
@@ -15,11 +16,14 @@ import (
 
 	"github.com/hashicorp/nomad/api"
 	"github.com/hashicorp/nomad/jobspec2"
+
+	"github.com/jeffwecan/waypoint-plugin-nomad-traefik/internal/monitor"
 )
 
 const (
-	metaId    = "waypoint.hashicorp.com/id"
-	metaNonce = "waypoint.hashicorp.com/nonce"
+	// defaultStderrLines is the number of lines of stderr shown for
+	// failed tasks.
+	defaultStderrLines = 10
 )
 
 // Config is the configuration structure for the Platform.
@@ -46,6 +50,67 @@ type Config struct {
 	// TODO Evaluate if this should remain as a default 3000, should be a required field,
 	// or default to another port.
 	ServicePort uint `hcl:"service_port,optional"`
+
+	// Template of a host name each deployment is reachable at before it is
+	// released, e.g. "{{.ID}}.preview.example.com". Every service tagged
+	// with a release router gets a Traefik router for it. The template can
+	// use .ID, .Name, .App and .Router.
+	PreviewDomain string `hcl:"preview_domain,optional"`
+
+	// The Traefik entrypoints of the preview routers.
+	PreviewEntryPoints []string `hcl:"preview_entrypoints,optional"`
+
+	// Terminate TLS on the preview routers, optionally obtaining the
+	// certificate from the given Traefik certificate resolver.
+	PreviewTLS          bool   `hcl:"preview_tls,optional"`
+	PreviewCertResolver string `hcl:"preview_cert_resolver,optional"`
+
+	// How long to wait for the job to be placed, and with
+	// wait_for_deployment for its Nomad deployment to finish, before giving
+	// up, e.g. "10m". Unset, the deployment waits until it is cancelled.
+	DeployTimeout string `hcl:"deploy_timeout,optional"`
+
+	// Wait for the Nomad deployment of jobs with an update block to
+	// finish, failing if Nomad marks it failed.
+	WaitForDeployment bool `hcl:"wait_for_deployment,optional"`
+
+	// Follow the deployment with the Nomad event stream rather than by
+	// querying the evaluation, falling back to queries when the stream is
+	// unavailable or denied by ACLs.
+	EventStream bool `hcl:"event_stream,optional"`
+
+	// The number of lines of stderr shown for failed tasks, defaults to 10.
+	// Set to 0 to not read the logs.
+	StderrLines *int `hcl:"stderr_lines,optional"`
+
+	// Show the scores of the best nodes when allocations cannot be placed.
+	PlacementScores bool `hcl:"placement_scores,optional"`
+
+	// What to do when allocations cannot be placed: "fail" the deployment,
+	// "wait" up to placement_timeout for capacity to place them, or
+	// "stop_job" to stop the partially placed job before failing.
+	OnPlacementFailure string `hcl:"on_placement_failure,optional"`
+	PlacementTimeout   string `hcl:"placement_timeout,optional"`
+
+	// Append the deployment events, e.g. allocation status changes, to
+	// this file as JSON lines.
+	EventLog string `hcl:"event_log,optional"`
+
+	// Log the deployment events with structured fields.
+	LogEvents bool `hcl:"log_events,optional"`
+
+	// Wait up to health_timeout for every instance of the services of the
+	// job to pass its Consul health checks.
+	WaitForHealthy bool   `hcl:"wait_for_healthy,optional"`
+	HealthTimeout  string `hcl:"health_timeout,optional"`
+
+	// Purge the job from Nomad when destroying a deployment, defaults to
+	// true. Otherwise it is only stopped.
+	Purge *bool `hcl:"purge,optional"`
+
+	// Prefix of the job meta keys recording where the job comes from,
+	// defaults to "waypoint.hashicorp.com/".
+	MetaPrefix string `hcl:"meta_prefix,optional"`
 }
 
 // AuthConfig maps the the Nomad Docker driver 'auth' config block
@@ -126,10 +191,27 @@ func (p *Platform) deploy(
 	ctx context.Context,
 	log hclog.Logger,
 	src *component.Source,
+	jobInfo *component.JobInfo,
 	img *docker.Image,
 	deployConfig *component.DeploymentConfig,
+	labels *component.LabelSet,
 	ui terminal.UI,
 ) (*Deployment, error) {
+	var timeout time.Duration
+	if p.config.DeployTimeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(p.config.DeployTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deploy_timeout %q: %s", p.config.DeployTimeout, err)
+		}
+	}
+	if _, _, err := p.placementPolicy(); err != nil {
+		return nil, err
+	}
+	if _, err := p.healthTimeout(); err != nil {
+		return nil, err
+	}
+
 	// Create our deployment and set an initial ID
 	var result Deployment
 	id, err := component.Id()
@@ -217,9 +299,20 @@ func (p *Platform) deploy(
 		return nil, err
 	}
 
-	// Set our ID on the meta.
-	job.SetMeta(metaId, result.Id)
-	job.SetMeta(metaNonce, time.Now().UTC().Format(time.RFC3339Nano))
+	// Set our ID and origin on the meta.
+	p.setMeta(job, result.Id, src, jobInfo, img, labels)
+
+	if p.config.PreviewDomain != "" {
+		urls, err := p.addPreviewRouters(job, &result, src.App)
+		if err != nil {
+			return nil, err
+		}
+		if len(urls) == 0 {
+			st.Step(terminal.StatusWarn, "No service is tagged with a release router, no preview URL configured")
+		} else {
+			result.Url = urls[0]
+		}
+	}
 
 	// Register job
 	st.Update("Registering job...")
@@ -232,10 +325,50 @@ func (p *Platform) deploy(
 	st.Step(terminal.StatusOK, "Job registration successful")
 
 	// Wait on the allocation
-	st.Update(fmt.Sprintf("Monitoring evaluation %q", evalID))
-
-	if err := newMonitor(st, client).monitor(evalID); err != nil {
-		return nil, err
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	handlers := []monitor.Handler{monitor.UIHandler(ui, st, p.config.PlacementScores)}
+	if p.config.EventLog != "" {
+		f, err := os.OpenFile(p.config.EventLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("error opening event_log: %s", err)
+		}
+		defer f.Close()
+		handlers = append(handlers, monitor.JSONHandler(f))
+	}
+	if p.config.LogEvents {
+		handlers = append(handlers, monitor.LogHandler(log))
+	}
+	mon := monitor.New(monitor.NewClient(client), handlers...)
+	mon.EventStream = p.config.EventStream
+	mon.LogLines = defaultStderrLines
+	if p.config.StderrLines != nil {
+		mon.LogLines = *p.config.StderrLines
+	}
+	eval, err := mon.Eval(ctx, evalID)
+	if err != nil {
+		if eval == nil || len(eval.FailedTGAllocs) == 0 {
+			return nil, err
+		}
+		eval, err = p.placementFailure(ctx, st, mon, jobclient, result.Name, eval, err)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Jobs with an update block get a Nomad deployment, which is done once
+	// the allocations are healthy.
+	if p.config.WaitForDeployment && eval.DeploymentID != "" {
+		if err := mon.Deployment(ctx, eval.DeploymentID); err != nil {
+			return nil, err
+		}
+	}
+	if p.config.WaitForHealthy {
+		if err := p.waitHealthy(ctx, st, client, result.Name); err != nil {
+			return nil, err
+		}
 	}
 	st.Step(terminal.StatusOK, "Deployment successfully rolled out!")
 
@@ -308,11 +441,148 @@ deploy {
 		"TCP port the job is listening on.",
 	)
 
+	doc.SetField(
+		"preview_domain",
+		"Template of the host name each deployment is reachable at before it is released.",
+		docs.Summary(
+			"Services tagged with waypoint.release-router get a Traefik router for this",
+			"host at deploy time. The template can use {{.ID}}, {{.Name}}, {{.App}} and",
+			"{{.Router}}, e.g. \"{{.ID}}.preview.example.com\".",
+		),
+	)
+
+	doc.SetField(
+		"preview_entrypoints",
+		"The Traefik entrypoints of the preview routers.",
+	)
+
+	doc.SetField(
+		"preview_tls",
+		"Terminate TLS on the preview routers.",
+	)
+
+	doc.SetField(
+		"preview_cert_resolver",
+		"The Traefik certificate resolver used for the preview routers.",
+	)
+
+	doc.SetField(
+		"deploy_timeout",
+		"How long to wait for the job to be placed, and its Nomad deployment to finish with wait_for_deployment, e.g. \"10m\".",
+		docs.Summary(
+			"When the deployment gives up, the state of the evaluation and of its",
+			"allocations is reported. Unset, it waits until the deployment is cancelled.",
+		),
+	)
+
+	doc.SetField(
+		"wait_for_deployment",
+		"Wait for the Nomad deployment of the job to finish.",
+		docs.Summary(
+			"Jobs with an update block get a Nomad deployment, which finishes once",
+			"the allocations are healthy or fails after the progress deadline.",
+			"Task failures and restarts are reported meanwhile.",
+		),
+		docs.Default("false"),
+	)
+
+	doc.SetField(
+		"event_stream",
+		"Follow the deployment with the Nomad event stream.",
+		docs.Summary(
+			"The stream is filtered to the job and requires Nomad 1.0 with ACL access to",
+			"its topics, otherwise the evaluation is queried instead.",
+		),
+		docs.Default("false"),
+	)
+
+	doc.SetField(
+		"stderr_lines",
+		"The number of lines of stderr shown for tasks failing during the deployment.",
+		docs.Summary("Set to 0 to not read the logs of failed tasks."),
+		docs.Default("10"),
+	)
+
+	doc.SetField(
+		"placement_scores",
+		"Show the scores of the best nodes when allocations cannot be placed.",
+		docs.Default("false"),
+	)
+
+	doc.SetField(
+		"on_placement_failure",
+		"What to do when allocations cannot be placed.",
+		docs.Summary(
+			"\"fail\" fails the deployment, leaving Nomad to place the allocations once",
+			"capacity is available. \"wait\" waits up to placement_timeout for them to be",
+			"placed. \"stop_job\" stops the partially placed job and fails the deployment.",
+		),
+		docs.Default("fail"),
+	)
+
+	doc.SetField(
+		"placement_timeout",
+		"How long the \"wait\" placement failure policy waits for capacity.",
+		docs.Default("5m"),
+	)
+
+	doc.SetField(
+		"event_log",
+		"A file the deployment events are appended to as JSON lines.",
+		docs.Summary(
+			"Events include evaluation status changes, allocations created, modified",
+			"or changing status, task failures, placement failures and deployment progress.",
+		),
+	)
+
+	doc.SetField(
+		"log_events",
+		"Log the deployment events with structured fields.",
+		docs.Default("false"),
+	)
+
+	doc.SetField(
+		"wait_for_healthy",
+		"Wait for every instance of the services of the job to pass its Consul health checks.",
+		docs.Summary(
+			"The output of the failing checks is reported if they don't pass",
+			"within health_timeout.",
+		),
+		docs.Default("false"),
+	)
+
+	doc.SetField(
+		"health_timeout",
+		"How long to wait for the services to be healthy.",
+		docs.Default("5m"),
+	)
+
+	doc.SetField(
+		"purge",
+		"Purge the job from Nomad when destroying a deployment, rather than only stopping it.",
+		docs.Default("true"),
+	)
+
+	doc.SetField(
+		"meta_prefix",
+		"Prefix of the job meta keys recording where the job comes from.",
+		docs.Summary(
+			"The meta records the deployment id, app, workspace, runner job, image,",
+			"git commit and branch when deploying from a repository, and the Waypoint",
+			"labels under \"label/\".",
+		),
+		docs.Default("waypoint.hashicorp.com/"),
+	)
+
 	return doc, nil
 }
 
+// URL is the preview URL of the deployment.
+func (d *Deployment) URL() string { return d.Url }
+
 var (
-	_ component.Platform     = (*Platform)(nil)
-	_ component.Configurable = (*Platform)(nil)
-	_ component.Destroyer    = (*Platform)(nil)
+	_ component.Platform           = (*Platform)(nil)
+	_ component.Configurable       = (*Platform)(nil)
+	_ component.Destroyer          = (*Platform)(nil)
+	_ component.WorkspaceDestroyer = (*Platform)(nil)
 )
@@ -2,10 +2,25 @@ package platform
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad/api"
+	"github.com/hashicorp/waypoint-plugin-sdk/component"
 	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
+
+	"github.com/jeffwecan/waypoint-plugin-nomad-traefik/internal/monitor"
+)
+
+const (
+	// defaultKillTimeout is Nomad's kill_timeout of tasks that don't set
+	// one.
+	defaultKillTimeout = 5 * time.Second
+
+	// stopSlack is added to the time allocations are waited for to stop.
+	stopSlack = time.Minute
 )
 
 // Implement the Destroyer interface
@@ -56,7 +71,146 @@ func (p *Platform) destroy(
 		return err
 	}
 
-	st.Update("Deleting job...")
-	_, _, err = client.Jobs().Deregister(deployment.Name, true, nil)
-	return err
+	return p.destroyJob(ctx, st, client, deployment.Name)
+}
+
+// destroyJob deregisters the job, purging it unless configured otherwise,
+// and waits for its allocations to stop. A job that doesn't exist is
+// considered destroyed already.
+func (p *Platform) destroyJob(ctx context.Context, st terminal.Status, client *api.Client, name string) error {
+	st.Update(fmt.Sprintf("Reading job %q...", name))
+	job, _, err := client.Jobs().Info(name, nil)
+	if err != nil {
+		if isNotFound(err) {
+			st.Step(terminal.StatusOK, fmt.Sprintf("Job %q not found, already destroyed", name))
+			return nil
+		}
+		return err
+	}
+
+	purge := p.config.Purge == nil || *p.config.Purge
+
+	st.Update(fmt.Sprintf("Deleting job %q...", name))
+	evalID, _, err := client.Jobs().Deregister(name, purge, nil)
+	if err != nil {
+		if isNotFound(err) {
+			st.Step(terminal.StatusOK, fmt.Sprintf("Job %q not found, already destroyed", name))
+			return nil
+		}
+		return err
+	}
+	st.Step(terminal.StatusOK, fmt.Sprintf("Job %q deregistered", name))
+
+	mon := monitor.New(monitor.NewClient(client), monitor.StatusHandler(st))
+	if evalID != "" {
+		if _, err := mon.Eval(ctx, evalID); err != nil {
+			return err
+		}
+	}
+
+	// Give the tasks the time they are configured to take to stop
+	timeout := stopTimeout(job)
+	st.Update(fmt.Sprintf("Waiting up to %s for the allocations to stop...", timeout))
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := mon.AllocsStopped(ctx, name); err != nil {
+		return err
+	}
+
+	st.Step(terminal.StatusOK, fmt.Sprintf("Job %q destroyed", name))
+	return nil
+}
+
+// isNotFound reports whether err is a 404 response of the Nomad API.
+func isNotFound(err error) bool {
+	return strings.Contains(err.Error(), "404")
+}
+
+// stopTimeout returns how long the tasks of job may take to stop: their
+// longest shutdown delay and kill timeout, plus some slack for the clients
+// to notice the job is stopped.
+func stopTimeout(job *api.Job) time.Duration {
+	var longest time.Duration
+	for _, tg := range job.TaskGroups {
+		var groupDelay time.Duration
+		if tg.ShutdownDelay != nil {
+			groupDelay = *tg.ShutdownDelay
+		}
+		for _, task := range tg.Tasks {
+			kill := defaultKillTimeout
+			if task.KillTimeout != nil {
+				kill = *task.KillTimeout
+			}
+			if d := groupDelay + task.ShutdownDelay + kill; d > longest {
+				longest = d
+			}
+		}
+	}
+	return longest + stopSlack
+}
+
+// Implement the WorkspaceDestroyer interface
+func (p *Platform) DestroyWorkspaceFunc() interface{} {
+	return p.destroyWorkspace
+}
+
+// destroyWorkspace destroys every job deployed for the app in the
+// workspace, as recorded in their meta.
+func (p *Platform) destroyWorkspace(
+	ctx context.Context,
+	log hclog.Logger,
+	src *component.Source,
+	jobInfo *component.JobInfo,
+	ui terminal.UI,
+) error {
+	st := ui.Status()
+	defer st.Close()
+
+	client, err := api.NewClient(api.DefaultConfig())
+	if err != nil {
+		return err
+	}
+
+	st.Update(fmt.Sprintf("Finding the jobs of app %q in workspace %q...", src.App, jobInfo.Workspace))
+	stubs, _, err := client.Jobs().PrefixList(strings.ToLower(src.App) + "-")
+	if err != nil {
+		return fmt.Errorf("error listing jobs: %s", err)
+	}
+
+	var names []string
+	for _, stub := range stubs {
+		job, _, err := client.Jobs().Info(stub.ID, nil)
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return fmt.Errorf("error reading job %q: %s", stub.ID, err)
+		}
+		if job.Meta[p.metaKey(metaApp)] == src.App &&
+			job.Meta[p.metaKey(metaWorkspace)] == jobInfo.Workspace {
+			names = append(names, stub.ID)
+		}
+	}
+	if len(names) == 0 {
+		st.Step(terminal.StatusOK, fmt.Sprintf("No job of app %q in workspace %q", src.App, jobInfo.Workspace))
+		return nil
+	}
+
+	// Destroy every job even if some fail
+	var failed []string
+	for _, name := range names {
+		if err := p.destroyJob(ctx, st, client, name); err != nil {
+			log.Error("error destroying job", "job", name, "error", err)
+			st.Step(terminal.StatusError, fmt.Sprintf("Error destroying job %q: %s", name, err))
+			failed = append(failed, name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("destroyed %d of %d jobs, failed to destroy: %s",
+			len(names)-len(failed), len(names), strings.Join(failed, ", "))
+	}
+	st.Step(terminal.StatusOK, fmt.Sprintf("Destroyed %d jobs of app %q in workspace %q",
+		len(names), src.App, jobInfo.Workspace))
+	return nil
 }
@@ -0,0 +1,222 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/nomad/api"
+	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
+
+	"github.com/jeffwecan/waypoint-plugin-nomad-traefik/internal/traefik"
+)
+
+const (
+	defaultHealthTimeout = 5 * time.Minute
+
+	// healthPollInterval is the time between two reads of the health of
+	// the services.
+	healthPollInterval = 2 * time.Second
+)
+
+// healthTimeout returns the parsed health_timeout or its default.
+func (p *Platform) healthTimeout() (time.Duration, error) {
+	if p.config.HealthTimeout == "" {
+		return defaultHealthTimeout, nil
+	}
+	d, err := time.ParseDuration(p.config.HealthTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid health_timeout %q: %s", p.config.HealthTimeout, err)
+	}
+	return d, nil
+}
+
+// expectedService is a service of the job registered in Consul by each
+// running allocation of the task groups declaring it.
+type expectedService struct {
+	name   string
+	groups []string
+	allocs []string
+}
+
+// waitHealthy waits for every task group of the job with services to have
+// running allocations of the current version of the job, each registered
+// in Consul with all its checks passing.
+func (p *Platform) waitHealthy(ctx context.Context, st terminal.Status, nomad *api.Client, jobID string) error {
+	timeout, err := p.healthTimeout()
+	if err != nil {
+		return err
+	}
+
+	st.Update("Waiting for the services to be healthy...")
+	job, expected, err := expectedServices(st, nomad, jobID)
+	if err != nil {
+		return err
+	}
+	if len(expected) == 0 {
+		return nil
+	}
+
+	consul, err := consulapi.NewClient(consulapi.DefaultConfig())
+	if err != nil {
+		return fmt.Errorf("error creating Consul client: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		problems, err := serviceProblems(ctx, nomad, consul, job, expected)
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+		if err == nil && len(problems) == 0 {
+			st.Step(terminal.StatusOK, "All service instances are healthy")
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if len(problems) == 0 {
+				return fmt.Errorf("services not healthy after %s: %s", timeout, ctx.Err())
+			}
+			return fmt.Errorf("services not healthy after %s:\n  %s",
+				timeout, strings.Join(problems, "\n  "))
+		case <-time.After(healthPollInterval):
+		}
+	}
+}
+
+// expectedServices returns the current version of the job and its Consul
+// services.
+func expectedServices(st terminal.Status, nomad *api.Client, jobID string) (*api.Job, []*expectedService, error) {
+	job, _, err := nomad.Jobs().Info(jobID, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading job %q: %s", jobID, err)
+	}
+
+	byName := make(map[string]*expectedService)
+	var result []*expectedService
+	for _, js := range traefik.Services(job) {
+		name, err := traefik.ConsulServiceName(job, js)
+		if err != nil {
+			st.Step(terminal.StatusWarn, fmt.Sprintf("Not waiting for service: %s", err))
+			continue
+		}
+		es, ok := byName[name]
+		if !ok {
+			es = &expectedService{name: name}
+			byName[name] = es
+			result = append(result, es)
+		}
+		es.groups = append(es.groups, js.Group)
+	}
+	return job, result, nil
+}
+
+// serviceProblems reads the running allocations of the current version of
+// the job and returns the task groups without any and the instances of the
+// expected services that are not healthy.
+func serviceProblems(ctx context.Context, nomad *api.Client, consul *consulapi.Client, job *api.Job, expected []*expectedService) ([]string, error) {
+	problems, err := runningAllocs(ctx, nomad, job, expected)
+	if err != nil {
+		return problems, err
+	}
+	health, err := healthProblems(ctx, consul, expected)
+	problems = append(problems, health...)
+	sort.Strings(problems)
+	return problems, err
+}
+
+// runningAllocs sets the allocations of the expected services to the
+// running allocations of the current version of the job, returning the
+// task groups that have none. Allocations still pending are not checked
+// yet, so such groups are never considered healthy.
+func runningAllocs(ctx context.Context, nomad *api.Client, job *api.Job, expected []*expectedService) ([]string, error) {
+	allocs, _, err := nomad.Jobs().Allocations(*job.ID, false, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error reading allocations of job %q: %s", *job.ID, err)
+	}
+
+	// The running allocations of each task group
+	groupAllocs := make(map[string][]string)
+	for _, alloc := range allocs {
+		if alloc.DesiredStatus != "run" || alloc.ClientStatus != "running" {
+			continue
+		}
+		if job.Version != nil && alloc.JobVersion != *job.Version {
+			continue
+		}
+		groupAllocs[alloc.TaskGroup] = append(groupAllocs[alloc.TaskGroup], alloc.ID)
+	}
+
+	var problems []string
+	reported := make(map[string]bool)
+	for _, es := range expected {
+		es.allocs = nil
+		for _, group := range es.groups {
+			if len(groupAllocs[group]) == 0 && !reported[group] {
+				reported[group] = true
+				problems = append(problems, fmt.Sprintf(
+					"task group %q has no running allocation of the current job version", group))
+			}
+			es.allocs = append(es.allocs, groupAllocs[group]...)
+		}
+	}
+	return problems, nil
+}
+
+// healthProblems returns the instances of the expected services that are
+// missing from Consul or have checks not passing.
+func healthProblems(ctx context.Context, consul *consulapi.Client, expected []*expectedService) ([]string, error) {
+	var problems []string
+	for _, es := range expected {
+		entries, _, err := consul.Health().Service(es.name, "", false,
+			(&consulapi.QueryOptions{}).WithContext(ctx))
+		if err != nil {
+			return problems, fmt.Errorf("error reading health of Consul service %q: %s", es.name, err)
+		}
+
+		// Count the instances registered by each allocation
+		registered := make(map[string]int)
+		for _, entry := range entries {
+			for _, allocID := range es.allocs {
+				if !strings.HasPrefix(entry.Service.ID, "_nomad-task-"+allocID+"-") {
+					continue
+				}
+				registered[allocID]++
+				if entry.Checks.AggregatedStatus() == consulapi.HealthPassing {
+					break
+				}
+				for _, check := range entry.Checks {
+					if check.Status == consulapi.HealthPassing {
+						continue
+					}
+					problems = append(problems, fmt.Sprintf(
+						"service %q of allocation %q on node %q: check %q is %s: %s",
+						es.name, allocID, entry.Node.Node, check.Name, check.Status,
+						strings.TrimSpace(check.Output)))
+				}
+				break
+			}
+		}
+
+		// Each allocation registers an instance for each service of its
+		// task group with the name, hence the count of allocs.
+		expectedCount := make(map[string]int)
+		for _, allocID := range es.allocs {
+			expectedCount[allocID]++
+		}
+		for allocID, n := range expectedCount {
+			if registered[allocID] < n {
+				problems = append(problems, fmt.Sprintf(
+					"service %q of allocation %q is not registered in Consul", es.name, allocID))
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems, nil
+}
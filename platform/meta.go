@@ -0,0 +1,122 @@
+package platform
+
+import (
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	"github.com/hashicorp/waypoint-plugin-sdk/component"
+	"github.com/hashicorp/waypoint/builtin/docker"
+)
+
+// defaultMetaPrefix prefixes the keys of the job meta set by the platform
+// unless meta_prefix is set.
+const defaultMetaPrefix = "waypoint.hashicorp.com/"
+
+// Keys of the job meta, after the prefix.
+const (
+	metaId        = "id"
+	metaNonce     = "nonce"
+	metaApp       = "app"
+	metaWorkspace = "workspace"
+	metaRunnerJob = "runner_job"
+	metaImage     = "image"
+	metaGitCommit = "git_commit"
+	metaGitRef    = "git_ref"
+
+	// metaLabelPrefix prefixes the Waypoint labels.
+	metaLabelPrefix = "label/"
+)
+
+// metaKey returns the job meta key for key, with the configured prefix.
+func (p *Platform) metaKey(key string) string {
+	prefix := defaultMetaPrefix
+	if p.config.MetaPrefix != "" {
+		prefix = p.config.MetaPrefix
+	}
+	return prefix + key
+}
+
+// setMeta records where the job comes from in its meta.
+func (p *Platform) setMeta(
+	job *api.Job,
+	id string,
+	src *component.Source,
+	jobInfo *component.JobInfo,
+	img *docker.Image,
+	labels *component.LabelSet,
+) {
+	job.SetMeta(p.metaKey(metaId), id)
+	job.SetMeta(p.metaKey(metaNonce), time.Now().UTC().Format(time.RFC3339Nano))
+	job.SetMeta(p.metaKey(metaApp), src.App)
+	job.SetMeta(p.metaKey(metaImage), img.Name())
+	if jobInfo != nil {
+		job.SetMeta(p.metaKey(metaWorkspace), jobInfo.Workspace)
+		if jobInfo.Id != "" {
+			job.SetMeta(p.metaKey(metaRunnerJob), jobInfo.Id)
+		}
+	}
+
+	commit, ref := gitInfo(src.Path)
+	if commit != "" {
+		job.SetMeta(p.metaKey(metaGitCommit), commit)
+	}
+	if ref != "" {
+		job.SetMeta(p.metaKey(metaGitRef), ref)
+	}
+
+	if labels != nil {
+		for k, v := range labels.Labels {
+			job.SetMeta(p.metaKey(metaLabelPrefix+k), v)
+		}
+	}
+}
+
+// gitInfo returns the commit and branch checked out at path, if it is a
+// git repository and git is available.
+func gitInfo(path string) (commit, ref string) {
+	if path == "" {
+		return "", ""
+	}
+	git := func(args ...string) string {
+		out, err := exec.Command("git", append([]string{"-C", path}, args...)...).Output()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	commit = git("rev-parse", "HEAD")
+	if commit == "" {
+		return "", ""
+	}
+	// A detached HEAD has no branch
+	if ref = git("rev-parse", "--abbrev-ref", "HEAD"); ref == "HEAD" {
+		ref = ""
+	}
+	return commit, ref
+}
+
+// IsDeploymentOf reports whether job was deployed by the platform for the
+// application called app, whatever the meta prefix it was deployed with.
+func IsDeploymentOf(job *api.Job, app string) bool {
+	if job == nil || job.ID == nil {
+		return false
+	}
+	for k, v := range job.Meta {
+		if !strings.HasSuffix(k, metaApp) {
+			continue
+		}
+		prefix := strings.TrimSuffix(k, metaApp)
+		if _, ok := job.Meta[prefix+metaId]; ok {
+			return v == app
+		}
+	}
+
+	// Jobs deployed before the app was recorded
+	if _, ok := job.Meta[defaultMetaPrefix+metaId]; !ok {
+		return false
+	}
+	return strings.HasPrefix(*job.ID, strings.ToLower(app)+"-")
+}
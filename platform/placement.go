@@ -0,0 +1,98 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
+
+	"github.com/jeffwecan/waypoint-plugin-nomad-traefik/internal/monitor"
+)
+
+// Values of on_placement_failure.
+const (
+	placementFail    = "fail"
+	placementWait    = "wait"
+	placementStopJob = "stop_job"
+
+	defaultPlacementTimeout = 5 * time.Minute
+)
+
+// placementPolicy returns the validated on_placement_failure option and
+// how long to wait for placement with the "wait" policy.
+func (p *Platform) placementPolicy() (string, time.Duration, error) {
+	policy := p.config.OnPlacementFailure
+	switch policy {
+	case "":
+		policy = placementFail
+	case placementFail, placementWait, placementStopJob:
+	default:
+		return "", 0, fmt.Errorf("invalid on_placement_failure %q, must be %q, %q or %q",
+			policy, placementFail, placementWait, placementStopJob)
+	}
+
+	timeout := defaultPlacementTimeout
+	if p.config.PlacementTimeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(p.config.PlacementTimeout)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid placement_timeout %q: %s", p.config.PlacementTimeout, err)
+		}
+	}
+	return policy, timeout, nil
+}
+
+// placementFailure applies the on_placement_failure policy to eval, which
+// failed to place all allocations of the job with err. It returns the
+// evaluation that eventually placed them with the "wait" policy.
+func (p *Platform) placementFailure(
+	ctx context.Context,
+	st terminal.Status,
+	mon *monitor.Monitor,
+	jobs *api.Jobs,
+	jobID string,
+	eval *api.Evaluation,
+	err error,
+) (*api.Evaluation, error) {
+	policy, timeout, perr := p.placementPolicy()
+	if perr != nil {
+		return nil, perr
+	}
+
+	switch policy {
+	case placementWait:
+		if eval.BlockedEval == "" {
+			return nil, err
+		}
+		st.Update(fmt.Sprintf("Waiting up to %s for capacity to place the remaining allocations...", timeout))
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		// Each blocked evaluation failing to place everything leaves
+		// another one behind
+		for eval.BlockedEval != "" {
+			next, err := mon.Eval(ctx, eval.BlockedEval)
+			if err == nil {
+				st.Step(terminal.StatusOK, "Remaining allocations placed")
+				return next, nil
+			}
+			if next == nil {
+				return nil, err
+			}
+			eval = next
+		}
+		return nil, err
+
+	case placementStopJob:
+		st.Update("Stopping the partially placed job...")
+		if _, _, derr := jobs.Deregister(jobID, false, nil); derr != nil {
+			return nil, fmt.Errorf("%s; stopping the job also failed: %s", err, derr)
+		}
+		st.Step(terminal.StatusWarn, fmt.Sprintf("Job %q stopped", jobID))
+		return nil, err
+	}
+
+	return nil, err
+}
@@ -0,0 +1,108 @@
+package platform
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/nomad/api"
+
+	"github.com/jeffwecan/waypoint-plugin-nomad-traefik/internal/traefik"
+)
+
+// previewData is the data available to the preview_domain template.
+type previewData struct {
+	// ID is the Waypoint deployment ID.
+	ID string
+
+	// Name is the name of the Nomad job, "<app>-<id>".
+	Name string
+
+	// App is the name of the Waypoint application.
+	App string
+
+	// Router is the name of the release router of the service.
+	Router string
+}
+
+// addPreviewRouters tags every service of job routed by the release
+// manager with a Traefik router serving the deployment on a host name of
+// its own, rendered from the preview_domain template. It returns the URLs
+// of the preview routers.
+func (p *Platform) addPreviewRouters(job *api.Job, deployment *Deployment, app string) ([]string, error) {
+	tmpl, err := template.New("preview_domain").Option("missingkey=error").Parse(p.config.PreviewDomain)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing preview_domain: %s", err)
+	}
+
+	scheme := "http"
+	if p.config.PreviewTLS {
+		scheme = "https"
+	}
+
+	var urls []string
+	routers := make(map[string]string)
+	for _, rs := range traefik.RoutedServices(job) {
+		var buf bytes.Buffer
+		err := tmpl.Execute(&buf, &previewData{
+			ID:     deployment.Id,
+			Name:   deployment.Name,
+			App:    app,
+			Router: rs.Router,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error rendering preview_domain: %s", err)
+		}
+		host := strings.ToLower(buf.String())
+
+		// Routers of the same job rendering the same host would split the
+		// preview traffic between them.
+		if other, ok := routers[host]; ok && other != rs.Router {
+			return nil, fmt.Errorf(
+				"preview_domain renders %q for both router %q and %q, use {{.Router}} to tell them apart",
+				host, other, rs.Router)
+		}
+
+		rule, err := traefik.HostRule([]string{host}, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid preview_domain: %s", err)
+		}
+
+		prefix := fmt.Sprintf("traefik.http.routers.%s.", previewRouterName(deployment, rs.Router))
+		tags := []string{prefix + "rule=" + rule}
+		if len(p.config.PreviewEntryPoints) > 0 {
+			tags = append(tags, prefix+"entrypoints="+strings.Join(p.config.PreviewEntryPoints, ","))
+		}
+		if p.config.PreviewTLS {
+			tags = append(tags, prefix+"tls=true")
+			if p.config.PreviewCertResolver != "" {
+				tags = append(tags, prefix+"tls.certresolver="+p.config.PreviewCertResolver)
+			}
+		}
+
+		var kept []string
+		for _, tag := range rs.Service.Tags {
+			if !strings.HasPrefix(tag, prefix) {
+				kept = append(kept, tag)
+			}
+		}
+		rs.Service.Tags = append(kept, tags...)
+
+		if _, ok := routers[host]; !ok {
+			routers[host] = rs.Router
+			u := url.URL{Scheme: scheme, Host: host}
+			urls = append(urls, u.String())
+		}
+	}
+
+	return urls, nil
+}
+
+// previewRouterName returns the name of the preview router of the release
+// router called router. Traefik router names are global, so it includes
+// the job name which is unique to the deployment.
+func previewRouterName(deployment *Deployment, router string) string {
+	return fmt.Sprintf("%s-%s-preview", deployment.Name, router)
+}
@@ -0,0 +1,173 @@
+package release
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/nomad/api"
+	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
+
+	"github.com/jeffwecan/waypoint-plugin-nomad-traefik/internal/monitor"
+	"github.com/jeffwecan/waypoint-plugin-nomad-traefik/internal/traefik"
+)
+
+// Route backends, selected with the backend option.
+const (
+	backendTags     = "tags"
+	backendConsulKV = "consul_kv"
+)
+
+// Traefik providers reading the routes of the backends, Traefik suffixing
+// the names of routers and services with them.
+const (
+	providerConsulCatalog = "consulcatalog"
+	providerConsulKV      = "consul"
+)
+
+// route is a router released for one of the services of the job.
+type route struct {
+	service traefik.RoutedService
+	router  *router
+}
+
+// routeBackend publishes the routes of a release to Traefik.
+type routeBackend interface {
+	// apply publishes routes, which belong to the services of job.
+	apply(ctx context.Context, st terminal.Status, job *api.Job, routes []*route) error
+
+	// revert undoes the last apply.
+	revert(ctx context.Context, st terminal.Status) error
+
+	// provider returns the Traefik provider loading the published routers.
+	provider() string
+}
+
+// newRouteBackend returns the route backend selected by the configuration.
+func (rm *ReleaseManager) newRouteBackend(client *api.Client, ui terminal.UI) (routeBackend, error) {
+	switch rm.config.Backend {
+	case "", backendTags:
+		return &tagBackend{
+			client:           client,
+			ui:               ui,
+			allowDestructive: rm.config.AllowDestructive,
+		}, nil
+	case backendConsulKV:
+		return newConsulKVBackend(rm.config.ConsulKV)
+	default:
+		return nil, fmt.Errorf("unknown backend %q, must be %q or %q",
+			rm.config.Backend, backendTags, backendConsulKV)
+	}
+}
+
+// tagBackend publishes routes as Traefik tags of the job's services and
+// registers the job again for the tags to reach Consul.
+type tagBackend struct {
+	client *api.Client
+	ui     terminal.UI
+
+	// allowDestructive registers the job even if Nomad plans to replace
+	// allocations for the tag change.
+	allowDestructive bool
+
+	// job is the job last applied and originalTags the service tags it had
+	// before, so that apply can be reverted.
+	job          *api.Job
+	originalTags map[*api.Service][]string
+}
+
+func (b *tagBackend) apply(ctx context.Context, st terminal.Status, job *api.Job, routes []*route) error {
+	b.job = job
+	b.originalTags = make(map[*api.Service][]string)
+	for _, rt := range routes {
+		svc := rt.service.Service
+		if _, ok := b.originalTags[svc]; !ok {
+			b.originalTags[svc] = svc.Tags
+		}
+		svc.Tags = append(stripRouterTags(svc.Tags, rt.router.name), rt.router.tags()...)
+	}
+
+	// Changing tags should only update allocations in place. Make sure of
+	// it before registering, as anything else restarts the application.
+	st.Update("Planning job update...")
+	plan, _, err := b.client.Jobs().Plan(job, false, nil)
+	if err != nil {
+		return fmt.Errorf("error planning job update: %s", err)
+	}
+	if plan.Warnings != "" {
+		st.Step(terminal.StatusWarn, fmt.Sprintf("Job plan warnings: %s", plan.Warnings))
+	}
+	if churn := reportPlan(st, plan); churn {
+		if !b.allowDestructive {
+			for svc, tags := range b.originalTags {
+				svc.Tags = tags
+			}
+			return fmt.Errorf("releasing would replace allocations of the job, " +
+				"set allow_destructive to release anyway")
+		}
+		st.Step(terminal.StatusWarn,
+			"WARNING: releasing replaces allocations of the job, the application will restart!")
+	}
+
+	return b.register(ctx, st, job)
+}
+
+func (b *tagBackend) provider() string { return providerConsulCatalog }
+
+func (b *tagBackend) revert(ctx context.Context, st terminal.Status) error {
+	for svc, tags := range b.originalTags {
+		svc.Tags = tags
+	}
+	return b.register(ctx, st, b.job)
+}
+
+// register registers the job and waits for its evaluation, and the Nomad
+// deployment it creates if any, to complete.
+func (b *tagBackend) register(ctx context.Context, st terminal.Status, job *api.Job) error {
+	st.Update("Updating job...")
+	regResult, _, err := b.client.Jobs().Register(job, nil)
+	if err != nil {
+		return err
+	}
+
+	mon := monitor.New(monitor.NewClient(b.client), monitor.UIHandler(b.ui, st, false))
+	eval, err := mon.Eval(ctx, regResult.EvalID)
+	if err != nil {
+		return err
+	}
+	if eval.DeploymentID != "" {
+		if err := mon.Deployment(ctx, eval.DeploymentID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reportPlan shows the allocation changes planned for each task group and
+// reports whether any allocation would be placed, stopped or destructively
+// updated.
+func reportPlan(st terminal.Status, plan *api.JobPlanResponse) bool {
+	if plan.Annotations == nil {
+		return false
+	}
+
+	groups := make([]string, 0, len(plan.Annotations.DesiredTGUpdates))
+	for tg := range plan.Annotations.DesiredTGUpdates {
+		groups = append(groups, tg)
+	}
+	sort.Strings(groups)
+
+	churn := false
+	for _, tg := range groups {
+		u := plan.Annotations.DesiredTGUpdates[tg]
+		status := terminal.StatusOK
+		if u.Place > 0 || u.Stop > 0 || u.DestructiveUpdate > 0 {
+			status = terminal.StatusWarn
+			churn = true
+		}
+		st.Step(status, fmt.Sprintf(
+			"Task group %q: %d in-place update(s), %d destructive update(s), %d place, %d stop, %d ignore",
+			tg, u.InPlaceUpdate, u.DestructiveUpdate, u.Place, u.Stop, u.Ignore))
+	}
+	return churn
+}
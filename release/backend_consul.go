@@ -0,0 +1,233 @@
+package release
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/nomad/api"
+	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
+
+	"github.com/jeffwecan/waypoint-plugin-nomad-traefik/internal/traefik"
+)
+
+const (
+	defaultConsulKVPrefix = "traefik"
+
+	// maxTxnOps is the number of operations Consul accepts in a
+	// transaction by default.
+	maxTxnOps = 64
+)
+
+// ConsulKVConfig configures the consul_kv route backend.
+type ConsulKVConfig struct {
+	// The root key Traefik's Consul KV provider reads, defaults to
+	// "traefik".
+	Prefix string `hcl:"prefix,optional"`
+
+	// The Traefik provider that creates the services of the job from the
+	// Consul catalog, referenced by the routers. Defaults to
+	// "consulcatalog".
+	ServiceProvider string `hcl:"service_provider,optional"`
+}
+
+// consulKVBackend publishes routes as Traefik dynamic configuration in
+// Consul KV, read by Traefik's Consul KV provider. The job itself is left
+// untouched: the routers reference the services Traefik's Consul catalog
+// provider creates for it, so the services need to be enabled for Traefik,
+// e.g. with a "traefik.enable=true" tag. Routers are stored under their
+// names alone, shared by every application, so the conflict check refuses
+// to overwrite the routers of another application.
+type consulKVBackend struct {
+	kv              *consulapi.KV
+	prefix          string
+	serviceProvider string
+
+	// The keys below each written router and middleware before the last
+	// apply, so that it can be reverted.
+	trees    []string
+	previous consulapi.KVPairs
+}
+
+func newConsulKVBackend(c *ConsulKVConfig) (*consulKVBackend, error) {
+	client, err := consulapi.NewClient(consulapi.DefaultConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	b := &consulKVBackend{
+		kv:              client.KV(),
+		prefix:          c.prefix(),
+		serviceProvider: providerConsulCatalog,
+	}
+	if c != nil && c.ServiceProvider != "" {
+		b.serviceProvider = c.ServiceProvider
+	}
+	return b, nil
+}
+
+// prefix returns the configured root key or its default, c being nil if
+// the consul_kv block is absent.
+func (c *ConsulKVConfig) prefix() string {
+	if c == nil || c.Prefix == "" {
+		return defaultConsulKVPrefix
+	}
+	return strings.Trim(c.Prefix, "/")
+}
+
+func (b *consulKVBackend) provider() string { return providerConsulKV }
+
+func (b *consulKVBackend) apply(ctx context.Context, st terminal.Status, job *api.Job, routes []*route) error {
+	var pairs consulapi.KVPairs
+	b.trees = nil
+	services := make(map[string]string)
+	for _, rt := range routes {
+		if rt.router.protocol != protocolHTTP {
+			return fmt.Errorf("router %q: the %s backend only supports http routers",
+				rt.router.name, backendConsulKV)
+		}
+
+		name, err := traefik.ConsulServiceName(job, rt.service.JobService)
+		if err != nil {
+			return fmt.Errorf("router %q: %s", rt.router.name, err)
+		}
+		service := normalizeServiceName(name) + "@" + b.serviceProvider
+
+		// A router in KV routes to exactly one service, unlike the same
+		// router tagged on several services in Consul.
+		if other, ok := services[rt.router.name]; ok {
+			if other != service {
+				return fmt.Errorf("router %q is tagged on services %q and %q, the %s backend can only route to one",
+					rt.router.name, other, service, backendConsulKV)
+			}
+			continue
+		}
+		services[rt.router.name] = service
+
+		pairs = append(pairs, b.routerPairs(rt.router, service)...)
+		b.trees = append(b.trees, b.routerTrees(rt.router)...)
+	}
+
+	// Remember what was there before, for revert.
+	q := (&consulapi.QueryOptions{}).WithContext(ctx)
+	b.previous = nil
+	for _, tree := range b.trees {
+		existing, _, err := b.kv.List(tree, q)
+		if err != nil {
+			return fmt.Errorf("error reading Consul KV %q: %s", tree, err)
+		}
+		b.previous = append(b.previous, existing...)
+	}
+
+	st.Update("Writing routes to Consul KV...")
+	return b.replace(ctx, pairs)
+}
+
+func (b *consulKVBackend) revert(ctx context.Context, st terminal.Status) error {
+	return b.replace(ctx, b.previous)
+}
+
+// replace deletes the trees of the routers and middlewares last applied
+// and writes pairs in a single transaction, so that Traefik never sees the
+// routers missing or half written. Only changes of more than maxTxnOps
+// keys are split into several transactions.
+func (b *consulKVBackend) replace(ctx context.Context, pairs consulapi.KVPairs) error {
+	var ops consulapi.KVTxnOps
+	for _, tree := range b.trees {
+		ops = append(ops, &consulapi.KVTxnOp{Verb: consulapi.KVDeleteTree, Key: tree})
+	}
+	for _, p := range pairs {
+		ops = append(ops, &consulapi.KVTxnOp{Verb: consulapi.KVSet, Key: p.Key, Value: p.Value})
+	}
+
+	q := (&consulapi.QueryOptions{}).WithContext(ctx)
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > maxTxnOps {
+			n = maxTxnOps
+		}
+		ok, resp, _, err := b.kv.Txn(ops[:n], q)
+		if err != nil {
+			return fmt.Errorf("error writing Consul KV: %s", err)
+		}
+		if !ok {
+			var errs []string
+			for _, e := range resp.Errors {
+				errs = append(errs, fmt.Sprintf("%s: %s", ops[e.OpIndex].Key, e.What))
+			}
+			return fmt.Errorf("error writing Consul KV: %s", strings.Join(errs, "; "))
+		}
+		ops = ops[n:]
+	}
+	return nil
+}
+
+// routerTrees returns the KV prefixes holding the router, its redirect
+// router and its managed middlewares.
+func (b *consulKVBackend) routerTrees(r *router) []string {
+	trees := []string{b.routerKey(r.name) + "/"}
+	for _, m := range r.managed {
+		trees = append(trees, b.middlewareKey(m.name)+"/")
+	}
+	if r.redirect != nil {
+		trees = append(trees, b.routerKey(r.redirect.name)+"/")
+	}
+	return trees
+}
+
+// routerPairs renders the router, its managed middlewares and any redirect
+// router as KV pairs, routing to service unless the router has its own.
+func (b *consulKVBackend) routerPairs(r *router, service string) consulapi.KVPairs {
+	settings := r.settings()
+	if r.service == "" {
+		settings = append(settings, valueSetting("service", service))
+	}
+	pairs := settingPairs(b.routerKey(r.name), settings)
+	for _, m := range r.managed {
+		pairs = append(pairs, settingPairs(b.middlewareKey(m.name)+"/"+m.kind, m.settings)...)
+	}
+	if r.redirect != nil {
+		pairs = append(pairs, b.routerPairs(r.redirect, service)...)
+	}
+	return pairs
+}
+
+func (b *consulKVBackend) routerKey(name string) string {
+	return fmt.Sprintf("%s/http/routers/%s", b.prefix, name)
+}
+
+func (b *consulKVBackend) middlewareKey(name string) string {
+	return fmt.Sprintf("%s/http/middlewares/%s", b.prefix, name)
+}
+
+// settingPairs renders settings as KV pairs below prefix. The dotted keys
+// of the settings become key paths and list values are indexed.
+func settingPairs(prefix string, settings []setting) consulapi.KVPairs {
+	var pairs consulapi.KVPairs
+	for _, s := range settings {
+		key := prefix + "/" + strings.Replace(s.key, ".", "/", -1)
+		if !s.list {
+			pairs = append(pairs, &consulapi.KVPair{Key: key, Value: []byte(s.values[0])})
+			continue
+		}
+		for i, v := range s.values {
+			pairs = append(pairs, &consulapi.KVPair{Key: key + "/" + strconv.Itoa(i), Value: []byte(v)})
+		}
+	}
+	return pairs
+}
+
+// normalizeServiceName returns the name Traefik's Consul catalog provider
+// gives the service registered as name, replacing anything but letters and
+// digits with dashes.
+func normalizeServiceName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '-'
+	}, name)
+}
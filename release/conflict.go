@@ -0,0 +1,240 @@
+package release
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/nomad/api"
+	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
+
+	"github.com/jeffwecan/waypoint-plugin-nomad-traefik/internal/traefik"
+	"github.com/jeffwecan/waypoint-plugin-nomad-traefik/platform"
+)
+
+var (
+	// ruleTagRe matches the rule tag of a Traefik HTTP or TCP router,
+	// capturing the router name and the rule.
+	ruleTagRe = regexp.MustCompile(`^traefik\.(?:http|tcp)\.routers\.([^.]+)\.rule=(.*)$`)
+
+	// nomadServiceIDRe matches the IDs Nomad registers services in Consul
+	// with, capturing the allocation ID.
+	nomadServiceIDRe = regexp.MustCompile(`^_nomad-task-([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})-`)
+)
+
+// conflict is a host already routed by a service outside of the release,
+// or a router of another application the release would overwrite if host
+// is empty.
+type conflict struct {
+	host    string
+	router  string
+	service string
+	owner   string
+}
+
+func (c *conflict) String() string {
+	if c.host == "" {
+		return fmt.Sprintf("router %q would be overwritten, it routes to service %q (%s)",
+			c.router, c.service, c.owner)
+	}
+	return fmt.Sprintf("host %q is already routed by router %q of service %q (%s)",
+		c.host, c.router, c.service, c.owner)
+}
+
+// checkConflicts returns an error if any host of the released routers is
+// already claimed by the router tags of a service registered in Consul,
+// unless that service belongs to the released job or to a previous
+// deployment of the same application, or by a router published in Consul
+// KV below kvPrefix other than the released ones. Routers in Consul KV are
+// named after the released routers alone, so it also returns an error if
+// any of them routes to a service of another application.
+func checkConflicts(st terminal.Status, nomad *api.Client, app, jobID, kvPrefix string, released []*router) error {
+	hosts := make(map[string]bool)
+	names := make(map[string]bool)
+	for _, r := range released {
+		names[r.name] = true
+		if r.redirect != nil {
+			names[r.redirect.name] = true
+		}
+		if r.rule == "" {
+			continue
+		}
+		for _, h := range traefik.RuleHosts(r.rule) {
+			hosts[h] = true
+		}
+	}
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	consul, err := consulapi.NewClient(consulapi.DefaultConfig())
+	if err != nil {
+		return err
+	}
+	services, _, err := consul.Catalog().Services(nil)
+	if err != nil {
+		return fmt.Errorf("error listing Consul services to check for conflicting routes: %s", err)
+	}
+
+	var conflicts []*conflict
+	for service, tags := range services {
+		// The hosts this service claims, mapped to the claiming router.
+		claimed := make(map[string]string)
+		for _, tag := range tags {
+			m := ruleTagRe.FindStringSubmatch(tag)
+			if m == nil {
+				continue
+			}
+			for _, h := range traefik.RuleHosts(m[2]) {
+				if hosts[h] {
+					claimed[h] = m[1]
+				}
+			}
+		}
+		if len(claimed) == 0 {
+			continue
+		}
+
+		owner, err := serviceOwner(consul, nomad, service, app, jobID)
+		if err != nil {
+			return err
+		}
+		if owner == "" {
+			continue
+		}
+		for h, router := range claimed {
+			conflicts = append(conflicts, &conflict{
+				host:    h,
+				router:  router,
+				service: service,
+				owner:   owner,
+			})
+		}
+	}
+
+	kvConflicts, err := kvConflicts(st, consul, nomad, kvPrefix, app, jobID, services, hosts, names)
+	if err != nil {
+		return err
+	}
+	conflicts = append(conflicts, kvConflicts...)
+
+	if len(conflicts) == 0 {
+		return nil
+	}
+	for _, c := range conflicts {
+		st.Step(terminal.StatusError, c.String())
+	}
+	return fmt.Errorf("%d conflicting route(s) found, refusing to release", len(conflicts))
+}
+
+// kvConflicts returns the hosts claimed by the routers published in Consul
+// KV below prefix, except for the routers named in names, and those of
+// the latter routing to services of another application than app, looked
+// up in catalog.
+func kvConflicts(st terminal.Status, consul *consulapi.Client, nomad *api.Client, prefix, app, jobID string,
+	catalog map[string][]string, hosts, names map[string]bool) ([]*conflict, error) {
+	pairs, _, err := consul.KV().List(prefix+"/", nil)
+	if err != nil {
+		// Consul KV may well be unused or denied by ACLs, which doesn't
+		// warrant refusing the release.
+		st.Step(terminal.StatusWarn, fmt.Sprintf(
+			"error listing Consul KV %q to check for conflicting routes: %s", prefix, err))
+		return nil, nil
+	}
+
+	values := make(map[string]string, len(pairs))
+	for _, p := range pairs {
+		values[p.Key] = string(p.Value)
+	}
+
+	ruleKeyRe := regexp.MustCompile(`^` + regexp.QuoteMeta(prefix) + `/(?:http|tcp)/routers/([^/]+)/rule$`)
+	var conflicts []*conflict
+	for _, p := range pairs {
+		m := ruleKeyRe.FindStringSubmatch(p.Key)
+		if m == nil {
+			continue
+		}
+		service := values[strings.TrimSuffix(p.Key, "rule")+"service"]
+
+		if names[m[1]] {
+			owner, err := kvServiceOwner(consul, nomad, catalog, service, app, jobID)
+			if err != nil {
+				return nil, err
+			}
+			if owner != "" {
+				conflicts = append(conflicts, &conflict{
+					router:  m[1],
+					service: service,
+					owner:   owner,
+				})
+			}
+			continue
+		}
+
+		for _, h := range traefik.RuleHosts(string(p.Value)) {
+			if !hosts[h] {
+				continue
+			}
+			conflicts = append(conflicts, &conflict{
+				host:    h,
+				router:  m[1],
+				service: service,
+				owner:   fmt.Sprintf("published in Consul KV at %q", p.Key),
+			})
+		}
+	}
+	return conflicts, nil
+}
+
+// kvServiceOwner describes what registered the Consul services Traefik
+// names service, as referenced by a router in Consul KV, that don't belong
+// to the released job or to other deployments of app. It returns an empty
+// string if there are none, e.g. because the service is gone.
+func kvServiceOwner(consul *consulapi.Client, nomad *api.Client, catalog map[string][]string, service, app, jobID string) (string, error) {
+	if i := strings.LastIndex(service, "@"); i >= 0 {
+		service = service[:i]
+	}
+	for name := range catalog {
+		if normalizeServiceName(name) != service {
+			continue
+		}
+		owner, err := serviceOwner(consul, nomad, name, app, jobID)
+		if err != nil || owner != "" {
+			return owner, err
+		}
+	}
+	return "", nil
+}
+
+// serviceOwner describes what registered the instances of the Consul
+// service that don't belong to the released job or to other deployments
+// of app. It returns an empty string if there are none.
+func serviceOwner(consul *consulapi.Client, nomad *api.Client, service, app, jobID string) (string, error) {
+	instances, _, err := consul.Catalog().Service(service, "", nil)
+	if err != nil {
+		return "", fmt.Errorf("error reading Consul service %q: %s", service, err)
+	}
+
+	for _, inst := range instances {
+		m := nomadServiceIDRe.FindStringSubmatch(inst.ServiceID)
+		if m == nil {
+			return fmt.Sprintf("registered outside of Nomad on node %q", inst.Node), nil
+		}
+
+		alloc, _, err := nomad.Allocations().Info(m[1], nil)
+		if err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				// The allocation was garbage collected, the service is
+				// about to be deregistered.
+				continue
+			}
+			return "", fmt.Errorf("error reading allocation of Consul service %q: %s", service, err)
+		}
+		if alloc.JobID == jobID || platform.IsDeploymentOf(alloc.Job, app) {
+			continue
+		}
+		return fmt.Sprintf("Nomad job %q", alloc.JobID), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,246 @@
+package release
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedirectSchemeConfig maps the Traefik 'redirectScheme' middleware.
+type RedirectSchemeConfig struct {
+	// The scheme to redirect to, defaults to "https".
+	Scheme string `hcl:"scheme,optional"`
+
+	// Use a permanent (301/308) rather than a temporary redirect.
+	Permanent bool `hcl:"permanent,optional"`
+
+	// The port to redirect to, when not the default for the scheme.
+	Port string `hcl:"port,optional"`
+
+	// When the router terminates TLS it never sees plain HTTP requests, so
+	// the redirect is served by a second router on these entrypoints
+	// instead. Defaults to every entrypoint, the redirect router only
+	// matching the requests without TLS.
+	EntryPoints []string `hcl:"entrypoints,optional"`
+}
+
+// BasicAuthConfig maps the Traefik 'basicAuth' middleware.
+type BasicAuthConfig struct {
+	// Users in htpasswd "name:hash" form. Only MD5 (apr1), SHA1 and bcrypt
+	// hashes are accepted; plain text passwords are rejected.
+	Users []string `hcl:"users"`
+
+	// The realm presented to the client.
+	Realm string `hcl:"realm,optional"`
+
+	// Remove the Authorization header before forwarding the request.
+	RemoveHeader bool `hcl:"remove_header,optional"`
+}
+
+// HeadersConfig maps the Traefik 'headers' middleware.
+type HeadersConfig struct {
+	CustomRequestHeaders  map[string]string `hcl:"custom_request_headers,optional"`
+	CustomResponseHeaders map[string]string `hcl:"custom_response_headers,optional"`
+
+	STSSeconds           int  `hcl:"sts_seconds,optional"`
+	STSIncludeSubdomains bool `hcl:"sts_include_subdomains,optional"`
+	STSPreload           bool `hcl:"sts_preload,optional"`
+	ForceSTSHeader       bool `hcl:"force_sts_header,optional"`
+
+	FrameDeny             bool   `hcl:"frame_deny,optional"`
+	ContentTypeNosniff    bool   `hcl:"content_type_nosniff,optional"`
+	BrowserXSSFilter      bool   `hcl:"browser_xss_filter,optional"`
+	ReferrerPolicy        string `hcl:"referrer_policy,optional"`
+	ContentSecurityPolicy string `hcl:"content_security_policy,optional"`
+}
+
+// RateLimitConfig maps the Traefik 'rateLimit' middleware.
+type RateLimitConfig struct {
+	// Average number of requests allowed per period.
+	Average int `hcl:"average"`
+
+	// Maximum number of requests allowed in the same short period.
+	Burst int `hcl:"burst,optional"`
+
+	// The period the average is computed over, e.g. "1s" or "1m".
+	Period string `hcl:"period,optional"`
+}
+
+// StripPrefixConfig maps the Traefik 'stripPrefix' middleware.
+type StripPrefixConfig struct {
+	// Prefixes to strip, defaults to the router's path_prefix.
+	Prefixes []string `hcl:"prefixes,optional"`
+}
+
+// middlewareKinds are the Traefik middleware types the release manages,
+// in the order they are attached to the router.
+var middlewareKinds = []string{
+	"redirectscheme",
+	"basicauth",
+	"headers",
+	"ratelimit",
+	"stripprefix",
+}
+
+// middleware is a Traefik HTTP middleware defined by the release.
+type middleware struct {
+	name     string
+	kind     string
+	settings []setting
+}
+
+// middlewareName returns the name of the middleware of the given kind
+// managed for the router called routerName.
+func middlewareName(routerName, kind string) string {
+	return fmt.Sprintf("%s-%s", routerName, kind)
+}
+
+// newMiddlewares builds the middlewares configured in c for the router
+// called routerName, in the order they should be attached.
+func newMiddlewares(routerName string, c *RouterConfig) ([]*middleware, error) {
+	var result []*middleware
+	add := func(kind string, settings []setting) {
+		result = append(result, &middleware{
+			name:     middlewareName(routerName, kind),
+			kind:     kind,
+			settings: settings,
+		})
+	}
+
+	if r := c.RedirectScheme; r != nil {
+		scheme := r.Scheme
+		if scheme == "" {
+			scheme = "https"
+		}
+		settings := []setting{valueSetting("scheme", scheme)}
+		if r.Permanent {
+			settings = append(settings, valueSetting("permanent", "true"))
+		}
+		if r.Port != "" {
+			settings = append(settings, valueSetting("port", r.Port))
+		}
+		add("redirectscheme", settings)
+	}
+
+	if b := c.BasicAuth; b != nil {
+		if len(b.Users) == 0 {
+			return nil, fmt.Errorf("basic_auth requires at least one user")
+		}
+		for _, u := range b.Users {
+			if err := validateHtpasswd(u); err != nil {
+				return nil, err
+			}
+		}
+		settings := []setting{listSetting("users", b.Users)}
+		if b.Realm != "" {
+			settings = append(settings, valueSetting("realm", b.Realm))
+		}
+		if b.RemoveHeader {
+			settings = append(settings, valueSetting("removeheader", "true"))
+		}
+		add("basicauth", settings)
+	}
+
+	if h := c.Headers; h != nil {
+		var settings []setting
+		settings = append(settings, headerSettings("customrequestheaders", h.CustomRequestHeaders)...)
+		settings = append(settings, headerSettings("customresponseheaders", h.CustomResponseHeaders)...)
+		if h.STSSeconds > 0 {
+			settings = append(settings, valueSetting("stsseconds", strconv.Itoa(h.STSSeconds)))
+		}
+		for _, b := range []struct {
+			key string
+			set bool
+		}{
+			{"stsincludesubdomains", h.STSIncludeSubdomains},
+			{"stspreload", h.STSPreload},
+			{"forcestsheader", h.ForceSTSHeader},
+			{"framedeny", h.FrameDeny},
+			{"contenttypenosniff", h.ContentTypeNosniff},
+			{"browserxssfilter", h.BrowserXSSFilter},
+		} {
+			if b.set {
+				settings = append(settings, valueSetting(b.key, "true"))
+			}
+		}
+		if h.ReferrerPolicy != "" {
+			settings = append(settings, valueSetting("referrerpolicy", h.ReferrerPolicy))
+		}
+		if h.ContentSecurityPolicy != "" {
+			settings = append(settings, valueSetting("contentsecuritypolicy", h.ContentSecurityPolicy))
+		}
+		if len(settings) == 0 {
+			return nil, fmt.Errorf("headers block does not set any headers")
+		}
+		add("headers", settings)
+	}
+
+	if r := c.RateLimit; r != nil {
+		if r.Average <= 0 {
+			return nil, fmt.Errorf("rate_limit average must be greater than zero")
+		}
+		settings := []setting{valueSetting("average", strconv.Itoa(r.Average))}
+		if r.Burst > 0 {
+			settings = append(settings, valueSetting("burst", strconv.Itoa(r.Burst)))
+		}
+		if r.Period != "" {
+			if _, err := time.ParseDuration(r.Period); err != nil {
+				return nil, fmt.Errorf("invalid rate_limit period %q: %s", r.Period, err)
+			}
+			settings = append(settings, valueSetting("period", r.Period))
+		}
+		add("ratelimit", settings)
+	}
+
+	if s := c.StripPrefix; s != nil {
+		prefixes := s.Prefixes
+		if len(prefixes) == 0 && c.PathPrefix != "" {
+			prefixes = []string{c.PathPrefix}
+		}
+		if len(prefixes) == 0 {
+			return nil, fmt.Errorf("strip_prefix requires prefixes or a path_prefix")
+		}
+		add("stripprefix", []setting{listSetting("prefixes", prefixes)})
+	}
+
+	return result, nil
+}
+
+// headerSettings renders a map of header names to values below key,
+// sorted so that the resulting tags are stable between releases.
+func headerSettings(key string, headers map[string]string) []setting {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := make([]setting, len(names))
+	for i, name := range names {
+		result[i] = valueSetting(key+"."+name, headers[name])
+	}
+	return result
+}
+
+// validateHtpasswd checks that user is a "name:hash" htpasswd entry using
+// one of the hash formats supported by Traefik.
+func validateHtpasswd(user string) error {
+	idx := strings.Index(user, ":")
+	if idx <= 0 {
+		return fmt.Errorf("basic_auth user %q must be in htpasswd name:hash form", user)
+	}
+	name, hash := user[:idx], user[idx+1:]
+	for _, prefix := range []string{"$apr1$", "$2a$", "$2b$", "$2y$", "{SHA}"} {
+		if strings.HasPrefix(hash, prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("basic_auth user %q must use an apr1, bcrypt or SHA1 password hash", name)
+}
+
+// tags renders the middleware as traefik.http.middlewares.<name>.* service tags.
+func (m *middleware) tags() []string {
+	return settingTags(fmt.Sprintf("traefik.http.middlewares.%s.%s.", m.name, m.kind), m.settings)
+}
@@ -3,17 +3,163 @@ package release
 import (
 	"context"
 	"fmt"
-	"regexp"
+
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"github.com/hashicorp/waypoint-plugin-sdk/component"
 	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
-	"github.com/jeffwecan/waypoint-plugin-nomad-traefik/platform"
 
-	"github.com/hashicorp/waypoint-plugin-sdk/component"
-	"github.com/hashicorp/nomad/api"
+	"github.com/jeffwecan/waypoint-plugin-nomad-traefik/internal/traefik"
+	"github.com/jeffwecan/waypoint-plugin-nomad-traefik/platform"
 )
 
 type ReleaseConfig struct {
-	Domain string `hcl:"domain"`
+	// Options of the default router, used for routers in the job without a
+	// router block of their own. See RouterConfig for their meaning; router
+	// blocks do not inherit them. The default router is only configured if
+	// protocol, domain or hosts are set.
+	Protocol       string                `hcl:"protocol,optional"`
+	Domain         string                `hcl:"domain,optional"`
+	Hosts          []string              `hcl:"hosts,optional"`
+	PathPrefix     string                `hcl:"path_prefix,optional"`
+	EntryPoints    []string              `hcl:"entrypoints,optional"`
+	TLS            *TLSConfig            `hcl:"tls,block"`
+	Port           int                   `hcl:"port,optional"`
+	Priority       int                   `hcl:"priority,optional"`
+	Middlewares    []string              `hcl:"middlewares,optional"`
+	RedirectScheme *RedirectSchemeConfig `hcl:"redirect_scheme,block"`
+	BasicAuth      *BasicAuthConfig      `hcl:"basic_auth,block"`
+	Headers        *HeadersConfig        `hcl:"headers,block"`
+	RateLimit      *RateLimitConfig      `hcl:"rate_limit,block"`
+	StripPrefix    *StripPrefixConfig    `hcl:"strip_prefix,block"`
+
+	// Configuration of individual routers, labeled with the router name of
+	// the "waypoint.release-router=<name>" service tag.
+	Routers []*RouterConfig `hcl:"router,block"`
+
+	// Check that Traefik picked up the routers before reporting success.
+	Verify *VerifyConfig `hcl:"verify,block"`
+
+	// Check that the application answers on the released URLs.
+	SmokeTest *SmokeTestConfig `hcl:"smoke_test,block"`
+
+	// Skip checking the Consul catalog and the Consul KV routers for other
+	// applications already routing the released hosts or, in Consul KV,
+	// using the names of the released routers.
+	SkipConflictCheck bool `hcl:"skip_conflict_check,optional"`
+
+	// How the routers are published to Traefik. "tags" (the default) adds
+	// them to the tags of the job's services and registers the job again,
+	// "consul_kv" writes them to Consul KV for Traefik's Consul KV provider
+	// and leaves the job untouched.
+	Backend string `hcl:"backend,optional"`
+
+	// Options of the consul_kv backend.
+	ConsulKV *ConsulKVConfig `hcl:"consul_kv,block"`
+
+	// Release with the tags backend even if Nomad plans to place, stop or
+	// destructively update allocations for the tag change, rather than
+	// only updating them in place.
+	AllowDestructive bool `hcl:"allow_destructive,optional"`
+}
+
+// RouterConfig configures a Traefik router of the released job.
+type RouterConfig struct {
+	// The router name, as found in the "waypoint.release-router" tag.
+	Name string `hcl:"name,label"`
+
+	// The type of Traefik router, one of "http", "tcp" or "udp". Defaults
+	// to "http". TCP routers match on the TLS SNI host name when tls is
+	// set and on every connection otherwise, UDP routers have no rule.
+	Protocol string `hcl:"protocol,optional"`
+
+	// The primary host the router matches on. Hosts of tcp routers without
+	// tls and of udp routers are only used for the release URLs.
+	Domain string `hcl:"domain,optional"`
+
+	// Additional hosts the router matches on alongside Domain.
+	Hosts []string `hcl:"hosts,optional"`
+
+	// Only route requests whose path starts with this prefix.
+	PathPrefix string `hcl:"path_prefix,optional"`
+
+	// The Traefik entrypoints the router listens on. When empty, Traefik
+	// attaches the router to all of its default entrypoints, except for
+	// udp routers which require them.
+	EntryPoints []string `hcl:"entrypoints,optional"`
+
+	// Terminate TLS on the router. Present but empty enables TLS using
+	// Traefik's default certificate.
+	TLS *TLSConfig `hcl:"tls,block"`
+
+	// The port Traefik serves the router on, used to build the release URL
+	// when it isn't the default port for the scheme.
+	Port int `hcl:"port,optional"`
+
+	// Router priority, Traefik defaults to the length of the rule.
+	Priority int `hcl:"priority,optional"`
+
+	// Names of already defined Traefik middlewares to attach to the router,
+	// after any of the middlewares configured below.
+	Middlewares []string `hcl:"middlewares,optional"`
+
+	// Middlewares defined by the release and attached to the router.
+	RedirectScheme *RedirectSchemeConfig `hcl:"redirect_scheme,block"`
+	BasicAuth      *BasicAuthConfig      `hcl:"basic_auth,block"`
+	Headers        *HeadersConfig        `hcl:"headers,block"`
+	RateLimit      *RateLimitConfig      `hcl:"rate_limit,block"`
+	StripPrefix    *StripPrefixConfig    `hcl:"strip_prefix,block"`
+}
+
+// defaultRouter returns the configuration used for routers without a router
+// block, or nil if there is none.
+func (c *ReleaseConfig) defaultRouter() *RouterConfig {
+	if c.Protocol == "" && c.Domain == "" && len(c.Hosts) == 0 {
+		return nil
+	}
+	return &RouterConfig{
+		Protocol:       c.Protocol,
+		Domain:         c.Domain,
+		Hosts:          c.Hosts,
+		PathPrefix:     c.PathPrefix,
+		EntryPoints:    c.EntryPoints,
+		TLS:            c.TLS,
+		Port:           c.Port,
+		Priority:       c.Priority,
+		Middlewares:    c.Middlewares,
+		RedirectScheme: c.RedirectScheme,
+		BasicAuth:      c.BasicAuth,
+		Headers:        c.Headers,
+		RateLimit:      c.RateLimit,
+		StripPrefix:    c.StripPrefix,
+	}
+}
+
+// routerConfig returns the configuration of the router called name.
+func (c *ReleaseConfig) routerConfig(name string) (*RouterConfig, error) {
+	for _, r := range c.Routers {
+		if r.Name == name {
+			return r, nil
+		}
+	}
+	if r := c.defaultRouter(); r != nil {
+		return r, nil
+	}
+	return nil, fmt.Errorf(
+		"router %q of the job has no router block and no default protocol, domain or hosts are configured", name)
+}
+
+// TLSConfig maps the Traefik router 'tls' options.
+type TLSConfig struct {
+	// Name of the certificate resolver used to obtain certificates.
+	CertResolver string `hcl:"cert_resolver,optional"`
+
+	// Name of the TLS options to apply to the router.
+	Options string `hcl:"options,optional"`
+
+	// Pass TLS connections through to the service without terminating
+	// them, tcp routers only.
+	Passthrough bool `hcl:"passthrough,optional"`
 }
 
 type ReleaseManager struct {
@@ -27,13 +173,48 @@ func (rm *ReleaseManager) Config() (interface{}, error) {
 
 // Implement ConfigurableNotify
 func (rm *ReleaseManager) ConfigSet(config interface{}) error {
-	_, ok := config.(*ReleaseConfig)
+	c, ok := config.(*ReleaseConfig)
 	if !ok {
 		// The Waypoint SDK should ensure this never gets hit
 		return fmt.Errorf("Expected *ReleaseConfig as parameter")
 	}
 
 	// validate the config
+	seen := make(map[string]bool)
+	for _, r := range c.Routers {
+		if seen[r.Name] {
+			return fmt.Errorf("router %q is configured more than once", r.Name)
+		}
+		seen[r.Name] = true
+		if _, err := newRouter(r.Name, r); err != nil {
+			return fmt.Errorf("router %q: %s", r.Name, err)
+		}
+	}
+	if r := c.defaultRouter(); r != nil {
+		if _, err := newRouter("", r); err != nil {
+			return err
+		}
+	} else if len(c.Routers) == 0 {
+		return fmt.Errorf("protocol, domain, hosts or at least one router block must be set")
+	}
+	if c.Verify != nil {
+		if c.Verify.Address == "" {
+			return fmt.Errorf("verify address must be set")
+		}
+		if _, err := c.Verify.timeout(); err != nil {
+			return err
+		}
+	}
+	if c.SmokeTest != nil {
+		if err := c.SmokeTest.validate(); err != nil {
+			return err
+		}
+	}
+	switch c.Backend {
+	case "", backendTags, backendConsulKV:
+	default:
+		return fmt.Errorf("unknown backend %q, must be %q or %q", c.Backend, backendTags, backendConsulKV)
+	}
 
 	return nil
 }
@@ -71,7 +252,13 @@ func (rm *ReleaseManager) ReleaseFunc() interface{} {
 //
 // If an error is returned, Waypoint stops the execution flow and
 // returns an error to the user.
-func (rm *ReleaseManager) release(ctx context.Context, ui terminal.UI, target *platform.Deployment, log hclog.Logger) (*Release, error) {
+func (rm *ReleaseManager) release(
+	ctx context.Context,
+	ui terminal.UI,
+	src *component.Source,
+	target *platform.Deployment,
+	log hclog.Logger,
+) (*Release, error) {
 	u := ui.Status()
 	log.Debug("release thinger", target)
 	defer u.Close()
@@ -85,55 +272,106 @@ func (rm *ReleaseManager) release(ctx context.Context, ui terminal.UI, target *p
 		// if not existing one bomb out
 		return nil, err
 	}
-	// our magic tag thing?
-	re := regexp.MustCompile("waypoint.release-router=(.*)")
-
-	for _, tg := range job.TaskGroups {
-		// log.Debug("%s: tg.services::", tg.Name)
-		for _, svc := range tg.Services {
-			log.Debug("task group service tags", tg.Name, svc.Name, svc.Tags)
-			routerName := ""
-			for _, tag := range svc.Tags {
-				// See if this service has our magic tag thing
-				match := re.FindStringSubmatch(tag)
-				if len(match) >= 1 {
-					routerName = match[1]
-				}
-			}
-			if routerName != "" {
-				svc.Tags = append(svc.Tags, fmt.Sprintf("traefik.http.routers.%s.rule=Host(`%s`)", routerName, rm.config.Domain))
-				log.Debug("updated task group service tags", tg.Name, svc.Name, svc.Tags)
-			}
+	backend, err := rm.newRouteBackend(client, ui)
+	if err != nil {
+		return nil, err
+	}
+
+	// The routers released, each router appearing once even if it is
+	// tagged on more than one service.
+	var released []*router
+	releasedNames := make(map[string]bool)
+
+	var routes []*route
+	for _, rs := range traefik.RoutedServices(job) {
+		log.Debug("service tags", rs.Service.Name, rs.Service.Tags)
+
+		cfg, err := rm.config.routerConfig(rs.Router)
+		if err != nil {
+			return nil, err
 		}
-		// for _, task := range tg.Tasks {
-		// 	// log.Debug("%s: task.services::", task.Name)
-		// 	for _, svc := range task.Services {
-		// 		log.Debug("task service tags", task.Name, svc.Name, svc.Tags)
-		// 	}
-		// }
+		r, err := newRouter(rs.Router, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("router %q: %s", rs.Router, err)
+		}
+		routes = append(routes, &route{service: rs, router: r})
+		if !releasedNames[rs.Router] {
+			releasedNames[rs.Router] = true
+			released = append(released, r)
+		}
+	}
+	if len(released) == 0 {
+		return nil, fmt.Errorf(
+			"no service of job %q is tagged with \"%s=<router name>\", nothing to release",
+			target.Name, traefik.ReleaseRouterTag)
 	}
 	log.Debug("Job found!: %s", job.ID)
 
-	// Register job
-	u.Update("Updating job...")
-	regResult, _, err := jobclient.Register(job, nil)
-	if err != nil {
-		return nil, err
+	if !rm.config.SkipConflictCheck {
+		u.Update("Checking for conflicting routes...")
+		err := checkConflicts(u, client, src.App, target.Name, rm.config.ConsulKV.prefix(), released)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	evalID := regResult.EvalID
-	log.Debug("released job evalID", evalID)
-
-	u.Step(terminal.StatusOK, "Deployment successfully releaseddd!")
+	if err := backend.apply(ctx, u, job, routes); err != nil {
+		return nil, err
+	}
 
 	// Create our deployment and set an initial ID
 	var result Release
 	result.Id = target.Id
 	result.Name = target.Name
-	result.Url = fmt.Sprintf("https://%s", rm.config.Domain)
+	for _, r := range released {
+		result.Urls = append(result.Urls, r.urls()...)
+	}
+	if len(result.Urls) > 0 {
+		result.Url = result.Urls[0]
+	}
+
+	if err := rm.check(ctx, u, released, backend.provider(), &result); err != nil {
+		u.Update("Reverting release...")
+		if rerr := backend.revert(ctx, u); rerr != nil {
+			return nil, fmt.Errorf("%s; reverting the release also failed: %s", err, rerr)
+		}
+		u.Step(terminal.StatusWarn, "Release reverted")
+		return nil, err
+	}
+
+	u.Step(terminal.StatusOK, "Deployment successfully releaseddd!")
+
 	return &result, nil
 }
 
+// check runs the configured post-release checks of the released routers,
+// loaded by the given Traefik provider.
+func (rm *ReleaseManager) check(ctx context.Context, st terminal.Status, released []*router, provider string, result *Release) error {
+	if rm.config.Verify != nil {
+		st.Update("Verifying the release with Traefik...")
+		if err := rm.config.Verify.verify(ctx, st, released, provider); err != nil {
+			return err
+		}
+	}
+
+	if rm.config.SmokeTest != nil {
+		// Only HTTP routers can be smoke tested.
+		var urls []string
+		for _, r := range released {
+			if r.protocol == protocolHTTP {
+				urls = append(urls, r.urls()...)
+			}
+		}
+		if len(urls) == 0 {
+			st.Step(terminal.StatusWarn, "No http routers were released, skipping the smoke test")
+		} else if err := rm.config.SmokeTest.run(ctx, st, urls); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // URL is a URL.
 func (r *Release) URL() string { return r.Url }
 
@@ -0,0 +1,370 @@
+package release
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jeffwecan/waypoint-plugin-nomad-traefik/internal/traefik"
+)
+
+// Router protocols, selecting the Traefik router type.
+const (
+	protocolHTTP = "http"
+	protocolTCP  = "tcp"
+	protocolUDP  = "udp"
+)
+
+// noopService is Traefik's internal service answering nothing, for routers
+// only there to run middlewares such as redirects.
+const noopService = "noop@internal"
+
+// router is a Traefik router as it will be rendered into the tags of a
+// Nomad service.
+type router struct {
+	name        string
+	protocol    string
+	rule        string
+	entryPoints []string
+	tls         *TLSConfig
+	priority    int
+
+	// service is the Traefik service of routers that must not route to
+	// the job, whose service is otherwise implied by the tags or set by
+	// the backend.
+	service string
+
+	// hosts, pathPrefix and port are what the rule was built from, kept to
+	// derive the URLs the router serves.
+	hosts      []string
+	pathPrefix string
+	port       int
+
+	// middlewares are the names of all middlewares attached to the router,
+	// managed ones being defined alongside the router.
+	middlewares []string
+	managed     []*middleware
+
+	// redirect is the plain HTTP router serving the scheme redirect when the
+	// router itself terminates TLS.
+	redirect *router
+}
+
+// setting is a single router or middleware option, key being the dotted
+// path below the router or middleware type.
+type setting struct {
+	key    string
+	values []string
+
+	// list is set for options holding a list of values, even if there is
+	// only one of them.
+	list bool
+}
+
+// valueSetting returns a setting holding a single value.
+func valueSetting(key, value string) setting {
+	return setting{key: key, values: []string{value}}
+}
+
+// listSetting returns a setting holding a list of values.
+func listSetting(key string, values []string) setting {
+	return setting{key: key, values: values, list: true}
+}
+
+// newRouter builds the router called name from its configuration.
+func newRouter(name string, c *RouterConfig) (*router, error) {
+	if c.Priority < 0 {
+		return nil, fmt.Errorf("priority must not be negative")
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", c.Port)
+	}
+
+	r := &router{
+		name:        name,
+		protocol:    c.protocol(),
+		entryPoints: c.EntryPoints,
+		tls:         c.TLS,
+		priority:    c.Priority,
+		hosts:       c.hosts(),
+		pathPrefix:  c.PathPrefix,
+		port:        c.Port,
+	}
+
+	var err error
+	switch r.protocol {
+	case protocolHTTP:
+		err = r.initHTTP(c)
+	case protocolTCP:
+		err = r.initTCP(c)
+	case protocolUDP:
+		err = r.initUDP(c)
+	default:
+		err = fmt.Errorf("unknown protocol %q, must be one of %q, %q or %q",
+			c.Protocol, protocolHTTP, protocolTCP, protocolUDP)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// initHTTP sets up an HTTP router with its rule and middlewares.
+func (r *router) initHTTP(c *RouterConfig) error {
+	if len(r.hosts) == 0 {
+		return fmt.Errorf("at least one of domain or hosts must be set")
+	}
+	if r.tls != nil && r.tls.Passthrough {
+		return fmt.Errorf("tls passthrough is only supported by tcp routers")
+	}
+
+	rule, err := traefik.HostRule(r.hosts, c.PathPrefix)
+	if err != nil {
+		return err
+	}
+	r.rule = rule
+
+	managed, err := newMiddlewares(r.name, c)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range managed {
+		if m.kind == "redirectscheme" && r.tls != nil {
+			// A TLS router can't redirect plain HTTP requests, so hand the
+			// redirect to a router of its own. Its own entrypoints are the
+			// TLS ones plain HTTP never reaches, so it is left on Traefik's
+			// defaults unless told otherwise. There it may also match
+			// requests an entrypoint terminated TLS for, which the redirect
+			// leaves as they are, so it routes to a service answering
+			// nothing rather than to the job.
+			r.redirect = &router{
+				name:        r.name + "-redirect",
+				protocol:    protocolHTTP,
+				rule:        rule,
+				entryPoints: c.RedirectScheme.EntryPoints,
+				service:     noopService,
+				priority:    c.Priority,
+				middlewares: []string{m.name},
+			}
+		} else {
+			r.middlewares = append(r.middlewares, m.name)
+		}
+		r.managed = append(r.managed, m)
+	}
+	r.middlewares = append(r.middlewares, c.Middlewares...)
+
+	return nil
+}
+
+// initTCP sets up a TCP router. Without TLS Traefik can't see the SNI
+// host name, so such routers match any connection on their entrypoints
+// and the hosts are only used for the release URLs.
+func (r *router) initTCP(c *RouterConfig) error {
+	if err := c.checkHTTPOnly(); err != nil {
+		return err
+	}
+
+	if r.tls == nil {
+		r.rule = "HostSNI(`*`)"
+		r.middlewares = c.Middlewares
+		return nil
+	}
+
+	if len(r.hosts) == 0 {
+		return fmt.Errorf("tcp routers with tls require domain or hosts to match on")
+	}
+	rule, err := traefik.HostSNIRule(r.hosts)
+	if err != nil {
+		return err
+	}
+	r.rule = rule
+	r.middlewares = c.Middlewares
+	return nil
+}
+
+// initUDP sets up a UDP router. UDP routers have no rule and receive every
+// datagram of their entrypoints, which are then the only setting telling
+// Traefik about the router.
+func (r *router) initUDP(c *RouterConfig) error {
+	if err := c.checkHTTPOnly(); err != nil {
+		return err
+	}
+	if len(r.entryPoints) == 0 {
+		return fmt.Errorf("udp routers require entrypoints")
+	}
+	if r.tls != nil {
+		return fmt.Errorf("udp routers do not support tls")
+	}
+	if r.priority > 0 {
+		return fmt.Errorf("udp routers do not support priority")
+	}
+	if len(c.Middlewares) > 0 {
+		return fmt.Errorf("udp routers do not support middlewares")
+	}
+	return nil
+}
+
+// checkHTTPOnly returns an error if c sets options only supported by HTTP
+// routers.
+func (c *RouterConfig) checkHTTPOnly() error {
+	if c.PathPrefix != "" {
+		return fmt.Errorf("path_prefix is only supported by http routers")
+	}
+	if c.RedirectScheme != nil || c.BasicAuth != nil || c.Headers != nil ||
+		c.RateLimit != nil || c.StripPrefix != nil {
+		return fmt.Errorf("redirect_scheme, basic_auth, headers, rate_limit and strip_prefix are only supported by http routers")
+	}
+	return nil
+}
+
+// protocol returns Protocol or its default.
+func (c *RouterConfig) protocol() string {
+	if c.Protocol == "" {
+		return protocolHTTP
+	}
+	return c.Protocol
+}
+
+// hosts returns Domain followed by Hosts, without duplicates.
+func (c *RouterConfig) hosts() []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, h := range append([]string{c.Domain}, c.Hosts...) {
+		if h == "" || seen[h] {
+			continue
+		}
+		seen[h] = true
+		result = append(result, h)
+	}
+	return result
+}
+
+// tlsEntryPoints are the entrypoint names Traefik's documentation uses for
+// HTTPS, routers on them are assumed to be served over TLS even without a
+// tls block as TLS is commonly configured on the entrypoint itself.
+var tlsEntryPoints = map[string]bool{
+	"websecure": true,
+	"https":     true,
+}
+
+// scheme returns the URL scheme clients use to reach the router.
+func (r *router) scheme() string {
+	if r.protocol != protocolHTTP {
+		return r.protocol
+	}
+	if r.tls != nil {
+		return "https"
+	}
+	for _, ep := range r.entryPoints {
+		if tlsEntryPoints[ep] {
+			return "https"
+		}
+	}
+	return "http"
+}
+
+// urls returns the URL of every host the router matches, in the order the
+// hosts were configured.
+func (r *router) urls() []string {
+	scheme := r.scheme()
+	result := make([]string, len(r.hosts))
+	for i, h := range r.hosts {
+		u := url.URL{Scheme: scheme, Host: h, Path: r.pathPrefix}
+		if r.port != 0 && !(scheme == "http" && r.port == 80) && !(scheme == "https" && r.port == 443) {
+			u.Host = net.JoinHostPort(h, strconv.Itoa(r.port))
+		}
+		result[i] = u.String()
+	}
+	return result
+}
+
+// settings returns the options of the router itself.
+func (r *router) settings() []setting {
+	var result []setting
+	if r.rule != "" {
+		result = append(result, valueSetting("rule", r.rule))
+	}
+	if len(r.entryPoints) > 0 {
+		result = append(result, listSetting("entrypoints", r.entryPoints))
+	}
+	if r.tls != nil {
+		result = append(result, valueSetting("tls", "true"))
+		if r.tls.CertResolver != "" {
+			result = append(result, valueSetting("tls.certresolver", r.tls.CertResolver))
+		}
+		if r.tls.Options != "" {
+			result = append(result, valueSetting("tls.options", r.tls.Options))
+		}
+		if r.tls.Passthrough {
+			result = append(result, valueSetting("tls.passthrough", "true"))
+		}
+	}
+	if r.priority > 0 {
+		result = append(result, valueSetting("priority", strconv.Itoa(r.priority)))
+	}
+	if len(r.middlewares) > 0 {
+		result = append(result, listSetting("middlewares", r.middlewares))
+	}
+	if r.service != "" {
+		result = append(result, valueSetting("service", r.service))
+	}
+	return result
+}
+
+// tags renders the router, its managed middlewares and any redirect router
+// as traefik.<protocol>.* service tags.
+func (r *router) tags() []string {
+	tags := settingTags(routerTagPrefix(r.protocol, r.name), r.settings())
+	for _, m := range r.managed {
+		tags = append(tags, m.tags()...)
+	}
+	if r.redirect != nil {
+		tags = append(tags, r.redirect.tags()...)
+	}
+	return tags
+}
+
+// settingTags renders settings as "<prefix><key>=<value>" tags, list values
+// being joined with commas as expected by Traefik's label parser.
+func settingTags(prefix string, settings []setting) []string {
+	tags := make([]string, len(settings))
+	for i, s := range settings {
+		tags[i] = prefix + s.key + "=" + strings.Join(s.values, ",")
+	}
+	return tags
+}
+
+func routerTagPrefix(protocol, name string) string {
+	return fmt.Sprintf("traefik.%s.routers.%s.", protocol, name)
+}
+
+// stripRouterTags removes any tags configuring the router called name, for
+// any protocol, its redirect router or the middlewares managed for it, so
+// that releasing the same deployment again replaces rather than duplicates
+// them.
+func stripRouterTags(tags []string, name string) []string {
+	prefixes := []string{
+		routerTagPrefix(protocolHTTP, name),
+		routerTagPrefix(protocolHTTP, name+"-redirect"),
+		routerTagPrefix(protocolTCP, name),
+		routerTagPrefix(protocolUDP, name),
+	}
+	for _, kind := range middlewareKinds {
+		prefixes = append(prefixes, fmt.Sprintf("traefik.http.middlewares.%s.", middlewareName(name, kind)))
+	}
+
+	result := make([]string, 0, len(tags))
+TAGS:
+	for _, tag := range tags {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(tag, prefix) {
+				continue TAGS
+			}
+		}
+		result = append(result, tag)
+	}
+	return result
+}
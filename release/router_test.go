@@ -0,0 +1,213 @@
+package release
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRouterTags(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  *RouterConfig
+		want    []string
+		wantErr string
+	}{
+		{
+			name:   "host",
+			config: &RouterConfig{Domain: "web.example.com", Hosts: []string{"www.example.com"}},
+			want: []string{
+				"traefik.http.routers.web.rule=Host(`web.example.com`, `www.example.com`)",
+			},
+		},
+		{
+			name:   "path prefix",
+			config: &RouterConfig{Domain: "web.example.com", PathPrefix: "/api"},
+			want: []string{
+				"traefik.http.routers.web.rule=Host(`web.example.com`) && PathPrefix(`/api`)",
+			},
+		},
+		{
+			name: "tls and priority",
+			config: &RouterConfig{
+				Domain:      "web.example.com",
+				EntryPoints: []string{"web", "websecure"},
+				TLS:         &TLSConfig{CertResolver: "le", Options: "modern"},
+				Priority:    10,
+				Middlewares: []string{"auth@file"},
+			},
+			want: []string{
+				"traefik.http.routers.web.rule=Host(`web.example.com`)",
+				"traefik.http.routers.web.entrypoints=web,websecure",
+				"traefik.http.routers.web.tls=true",
+				"traefik.http.routers.web.tls.certresolver=le",
+				"traefik.http.routers.web.tls.options=modern",
+				"traefik.http.routers.web.priority=10",
+				"traefik.http.routers.web.middlewares=auth@file",
+			},
+		},
+		{
+			name: "middlewares",
+			config: &RouterConfig{
+				Domain:      "web.example.com",
+				PathPrefix:  "/api",
+				Middlewares: []string{"auth@file"},
+				BasicAuth:   &BasicAuthConfig{Users: []string{"u:$apr1$x$y"}, Realm: "web"},
+				Headers: &HeadersConfig{
+					CustomRequestHeaders: map[string]string{"X-B": "2", "X-A": "1"},
+					FrameDeny:            true,
+				},
+				RateLimit:   &RateLimitConfig{Average: 100, Burst: 50},
+				StripPrefix: &StripPrefixConfig{},
+			},
+			want: []string{
+				"traefik.http.routers.web.rule=Host(`web.example.com`) && PathPrefix(`/api`)",
+				"traefik.http.routers.web.middlewares=web-basicauth,web-headers,web-ratelimit,web-stripprefix,auth@file",
+				"traefik.http.middlewares.web-basicauth.basicauth.users=u:$apr1$x$y",
+				"traefik.http.middlewares.web-basicauth.basicauth.realm=web",
+				"traefik.http.middlewares.web-headers.headers.customrequestheaders.X-A=1",
+				"traefik.http.middlewares.web-headers.headers.customrequestheaders.X-B=2",
+				"traefik.http.middlewares.web-headers.headers.framedeny=true",
+				"traefik.http.middlewares.web-ratelimit.ratelimit.average=100",
+				"traefik.http.middlewares.web-ratelimit.ratelimit.burst=50",
+				"traefik.http.middlewares.web-stripprefix.stripprefix.prefixes=/api",
+			},
+		},
+		{
+			name: "redirect without tls",
+			config: &RouterConfig{
+				Domain:         "web.example.com",
+				RedirectScheme: &RedirectSchemeConfig{Permanent: true},
+			},
+			want: []string{
+				"traefik.http.routers.web.rule=Host(`web.example.com`)",
+				"traefik.http.routers.web.middlewares=web-redirectscheme",
+				"traefik.http.middlewares.web-redirectscheme.redirectscheme.scheme=https",
+				"traefik.http.middlewares.web-redirectscheme.redirectscheme.permanent=true",
+			},
+		},
+		{
+			name: "redirect router",
+			config: &RouterConfig{
+				Domain:         "web.example.com",
+				EntryPoints:    []string{"websecure"},
+				TLS:            &TLSConfig{},
+				Priority:       5,
+				RedirectScheme: &RedirectSchemeConfig{EntryPoints: []string{"web"}},
+			},
+			want: []string{
+				"traefik.http.routers.web.rule=Host(`web.example.com`)",
+				"traefik.http.routers.web.entrypoints=websecure",
+				"traefik.http.routers.web.tls=true",
+				"traefik.http.routers.web.priority=5",
+				"traefik.http.middlewares.web-redirectscheme.redirectscheme.scheme=https",
+				"traefik.http.routers.web-redirect.rule=Host(`web.example.com`)",
+				"traefik.http.routers.web-redirect.entrypoints=web",
+				"traefik.http.routers.web-redirect.priority=5",
+				"traefik.http.routers.web-redirect.middlewares=web-redirectscheme",
+				"traefik.http.routers.web-redirect.service=noop@internal",
+			},
+		},
+		{
+			name: "tcp with tls",
+			config: &RouterConfig{
+				Protocol: protocolTCP,
+				Domain:   "db.example.com",
+				TLS:      &TLSConfig{Passthrough: true},
+			},
+			want: []string{
+				"traefik.tcp.routers.web.rule=HostSNI(`db.example.com`)",
+				"traefik.tcp.routers.web.tls=true",
+				"traefik.tcp.routers.web.tls.passthrough=true",
+			},
+		},
+		{
+			name:   "tcp without tls",
+			config: &RouterConfig{Protocol: protocolTCP, EntryPoints: []string{"db"}},
+			want: []string{
+				"traefik.tcp.routers.web.rule=HostSNI(`*`)",
+				"traefik.tcp.routers.web.entrypoints=db",
+			},
+		},
+		{
+			name:   "udp",
+			config: &RouterConfig{Protocol: protocolUDP, EntryPoints: []string{"dns"}},
+			want: []string{
+				"traefik.udp.routers.web.entrypoints=dns",
+			},
+		},
+		{
+			name:    "udp without entrypoints",
+			config:  &RouterConfig{Protocol: protocolUDP},
+			wantErr: "udp routers require entrypoints",
+		},
+		{
+			name:    "no hosts",
+			config:  &RouterConfig{PathPrefix: "/api"},
+			wantErr: "at least one of domain or hosts must be set",
+		},
+		{
+			name:    "rejected host",
+			config:  &RouterConfig{Domain: "web.example.com`) || Host(`evil.com"},
+			wantErr: "invalid host \"web.example.com`) || Host(`evil.com\"",
+		},
+		{
+			name: "plain basic auth password",
+			config: &RouterConfig{
+				Domain:    "web.example.com",
+				BasicAuth: &BasicAuthConfig{Users: []string{"u:secret"}},
+			},
+			wantErr: `basic_auth user "u" must use an apr1, bcrypt or SHA1 password hash`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := newRouter("web", tc.config)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %s", err)
+			case tc.wantErr != "":
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if got := r.tags(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected tags\n%q\ngot\n%q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestStripRouterTags(t *testing.T) {
+	tags := []string{
+		"traefik.enable=true",
+		"waypoint.release-router=web",
+		"traefik.http.routers.web.rule=Host(`web.example.com`)",
+		"traefik.http.routers.web.tls=true",
+		"traefik.tcp.routers.web.rule=HostSNI(`*`)",
+		"traefik.udp.routers.web.entrypoints=dns",
+		"traefik.http.routers.web-redirect.service=noop@internal",
+		"traefik.http.middlewares.web-redirectscheme.redirectscheme.scheme=https",
+		"traefik.http.middlewares.web-basicauth.basicauth.users=u:$apr1$x$y",
+		"traefik.http.middlewares.web-headers.headers.framedeny=true",
+		"traefik.http.middlewares.web-ratelimit.ratelimit.average=100",
+		"traefik.http.middlewares.web-stripprefix.stripprefix.prefixes=/api",
+		"traefik.http.routers.webx.rule=Host(`webx.example.com`)",
+		"traefik.http.routers.web-api.rule=Host(`api.example.com`)",
+		"traefik.http.middlewares.webx-headers.headers.framedeny=true",
+		"traefik.http.middlewares.web-auth.basicauth.users=u:$apr1$x$y",
+	}
+
+	want := []string{
+		"traefik.enable=true",
+		"waypoint.release-router=web",
+		"traefik.http.routers.webx.rule=Host(`webx.example.com`)",
+		"traefik.http.routers.web-api.rule=Host(`api.example.com`)",
+		"traefik.http.middlewares.webx-headers.headers.framedeny=true",
+		"traefik.http.middlewares.web-auth.basicauth.users=u:$apr1$x$y",
+	}
+	if got := stripRouterTags(tags, "web"); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected tags\n%q\ngot\n%q", want, got)
+	}
+}
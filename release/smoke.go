@@ -0,0 +1,175 @@
+package release
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
+)
+
+const (
+	// smokeWait is the amount of time to wait between failed smoke test
+	// attempts.
+	smokeWait = 2 * time.Second
+
+	defaultSmokeTimeout = 10 * time.Second
+	defaultSmokeRetries = 5
+)
+
+// SmokeTestConfig configures HTTP requests made against the released URLs
+// to check that the application answers.
+type SmokeTestConfig struct {
+	// The path requested, relative to the release URL. Defaults to the
+	// release URL itself.
+	Path string `hcl:"path,optional"`
+
+	// The status code the response must have, defaults to 200.
+	ExpectedStatus int `hcl:"expected_status,optional"`
+
+	// A regular expression the response body must match.
+	BodyRegex string `hcl:"body_regex,optional"`
+
+	// Timeout of each request, defaults to "10s".
+	Timeout string `hcl:"timeout,optional"`
+
+	// How many times a failed request is retried, defaults to 5.
+	Retries *int `hcl:"retries,optional"`
+
+	// Connect to this "host:port" instead of resolving the released host,
+	// e.g. the address of a Traefik instance, so that the release can be
+	// tested before DNS points at it.
+	ResolveTo string `hcl:"resolve_to,optional"`
+}
+
+// timeout returns the parsed Timeout or its default.
+func (c *SmokeTestConfig) timeout() (time.Duration, error) {
+	if c.Timeout == "" {
+		return defaultSmokeTimeout, nil
+	}
+	d, err := time.ParseDuration(c.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid smoke_test timeout %q: %s", c.Timeout, err)
+	}
+	return d, nil
+}
+
+// validate checks the smoke test configuration.
+func (c *SmokeTestConfig) validate() error {
+	if _, err := c.timeout(); err != nil {
+		return err
+	}
+	if c.Retries != nil && *c.Retries < 0 {
+		return fmt.Errorf("smoke_test retries must not be negative")
+	}
+	if c.BodyRegex != "" {
+		if _, err := regexp.Compile(c.BodyRegex); err != nil {
+			return fmt.Errorf("invalid smoke_test body_regex: %s", err)
+		}
+	}
+	if c.ResolveTo != "" {
+		if _, _, err := net.SplitHostPort(c.ResolveTo); err != nil {
+			return fmt.Errorf("smoke_test resolve_to must be in host:port form: %s", err)
+		}
+	}
+	return nil
+}
+
+// client returns the HTTP client used for the smoke test requests.
+func (c *SmokeTestConfig) client(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.ResolveTo != "" {
+		dialer := &net.Dialer{Timeout: timeout}
+		transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, c.ResolveTo)
+		}
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		// The response to the released URL is what's being tested, so
+		// redirects aren't followed.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// check makes a single request to target and returns an error if the
+// response does not match the expectations.
+func (c *SmokeTestConfig) check(ctx context.Context, client *http.Client, target string) error {
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	expected := c.ExpectedStatus
+	if expected == 0 {
+		expected = http.StatusOK
+	}
+	if resp.StatusCode != expected {
+		return fmt.Errorf("GET %s returned %q, expected %d", target, resp.Status, expected)
+	}
+
+	if c.BodyRegex != "" {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if !regexp.MustCompile(c.BodyRegex).Match(body) {
+			return fmt.Errorf("GET %s response body does not match %q", target, c.BodyRegex)
+		}
+	}
+	return nil
+}
+
+// run requests the smoke test path below each of urls, retrying failed
+// requests, and returns an error if any of them never passes.
+func (c *SmokeTestConfig) run(ctx context.Context, st terminal.Status, urls []string) error {
+	timeout, err := c.timeout()
+	if err != nil {
+		return err
+	}
+	retries := defaultSmokeRetries
+	if c.Retries != nil {
+		retries = *c.Retries
+	}
+	client := c.client(timeout)
+
+	for _, u := range urls {
+		target := u
+		if c.Path != "" {
+			target = strings.TrimSuffix(u, "/") + "/" + strings.TrimPrefix(c.Path, "/")
+		}
+
+		for attempt := 0; ; attempt++ {
+			st.Update(fmt.Sprintf("Smoke testing %s...", target))
+			err := c.check(ctx, client, target)
+			if err == nil {
+				st.Step(terminal.StatusOK, fmt.Sprintf("Smoke test of %s passed", target))
+				break
+			}
+			if attempt >= retries {
+				st.Step(terminal.StatusError, err.Error())
+				return fmt.Errorf("smoke test of %s failed after %d attempt(s)", target, attempt+1)
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(smokeWait):
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package release
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
+)
+
+const (
+	// verifyWait is the amount of time to wait between polls of the
+	// Traefik API while verifying a release.
+	verifyWait = 2 * time.Second
+
+	defaultVerifyTimeout = 2 * time.Minute
+)
+
+// VerifyConfig configures checking that Traefik picked up the released
+// routers through the Traefik API.
+type VerifyConfig struct {
+	// Address of the Traefik API, e.g. "http://traefik.service.consul:8080".
+	Address string `hcl:"address"`
+
+	// How long to wait for the routers to become healthy, defaults to "2m".
+	Timeout string `hcl:"timeout,optional"`
+
+	// The Traefik provider the routers are loaded by, defaults to the
+	// provider reading the backend: "consulcatalog" for tags and "consul"
+	// for consul_kv.
+	Provider string `hcl:"provider,optional"`
+}
+
+// timeout returns the parsed Timeout or its default.
+func (c *VerifyConfig) timeout() (time.Duration, error) {
+	if c.Timeout == "" {
+		return defaultVerifyTimeout, nil
+	}
+	d, err := time.ParseDuration(c.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid verify timeout %q: %s", c.Timeout, err)
+	}
+	return d, nil
+}
+
+// provider returns Provider, or def if unset.
+func (c *VerifyConfig) provider(def string) string {
+	if c.Provider == "" {
+		return def
+	}
+	return c.Provider
+}
+
+// traefikRouter is the subset of a router returned by the Traefik API
+// that is used for verification.
+type traefikRouter struct {
+	Name    string   `json:"name"`
+	Status  string   `json:"status"`
+	Service string   `json:"service"`
+	Rule    string   `json:"rule"`
+	Errors  []string `json:"error"`
+}
+
+// traefikService is the subset of a service returned by the Traefik API
+// that is used for verification. Servers of HTTP services have a URL,
+// those of TCP and UDP services an address.
+type traefikService struct {
+	Name         string            `json:"name"`
+	Status       string            `json:"status"`
+	ServerStatus map[string]string `json:"serverStatus"`
+	LoadBalancer *struct {
+		Servers []struct {
+			URL     string `json:"url"`
+			Address string `json:"address"`
+		} `json:"servers"`
+	} `json:"loadBalancer"`
+	Errors []string `json:"error"`
+}
+
+// healthy reports whether the service has at least one server able to
+// receive traffic. Traefik only reports server status for services with
+// health checks, otherwise any server is assumed to be up.
+func (s *traefikService) healthy() bool {
+	if len(s.ServerStatus) > 0 {
+		for _, status := range s.ServerStatus {
+			if status == "UP" {
+				return true
+			}
+		}
+		return false
+	}
+	return s.LoadBalancer != nil && len(s.LoadBalancer.Servers) > 0
+}
+
+// traefikAPI is a minimal client for the Traefik API.
+type traefikAPI struct {
+	address string
+	client  *http.Client
+}
+
+func newTraefikAPI(address string) *traefikAPI {
+	return &traefikAPI{
+		address: strings.TrimSuffix(address, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// get decodes the JSON document at path into v. It returns false if the
+// document does not exist.
+func (t *traefikAPI) get(ctx context.Context, path string, v interface{}) (bool, error) {
+	req, err := http.NewRequest("GET", t.address+path, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := t.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode != http.StatusOK:
+		return false, fmt.Errorf("unexpected response from Traefik API %s: %s", path, resp.Status)
+	}
+	return true, json.NewDecoder(resp.Body).Decode(v)
+}
+
+// router returns the named router of the given protocol, or nil if Traefik
+// doesn't know it.
+func (t *traefikAPI) router(ctx context.Context, protocol, name string) (*traefikRouter, error) {
+	var r traefikRouter
+	found, err := t.get(ctx, "/api/"+protocol+"/routers/"+url.PathEscape(name), &r)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// service returns the named service of the given protocol, or nil if
+// Traefik doesn't know it.
+func (t *traefikAPI) service(ctx context.Context, protocol, name string) (*traefikService, error) {
+	var s traefikService
+	found, err := t.get(ctx, "/api/"+protocol+"/services/"+url.PathEscape(name), &s)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// checkRouter returns nil if the router called name is enabled and its
+// service has healthy servers, otherwise an error describing why not.
+func (t *traefikAPI) checkRouter(ctx context.Context, protocol, name, provider string) error {
+	qualified := name + "@" + provider
+	r, err := t.router(ctx, protocol, qualified)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return fmt.Errorf("router %q not found", qualified)
+	}
+	if r.Status != "enabled" || len(r.Errors) > 0 {
+		return fmt.Errorf("router %q is %s: %s", qualified, r.Status, strings.Join(r.Errors, "; "))
+	}
+
+	service := r.Service
+	if !strings.Contains(service, "@") {
+		service += "@" + provider
+	}
+	s, err := t.service(ctx, protocol, service)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return fmt.Errorf("service %q of router %q not found", service, qualified)
+	}
+	if !s.healthy() {
+		return fmt.Errorf("service %q of router %q has no healthy servers", service, qualified)
+	}
+	return nil
+}
+
+// verify polls the Traefik API until every one of routers is enabled and
+// has healthy servers, or the configured timeout expires.
+func (c *VerifyConfig) verify(ctx context.Context, st terminal.Status, routers []*router, defaultProvider string) error {
+	timeout, err := c.timeout()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	api := newTraefikAPI(c.Address)
+	provider := c.provider(defaultProvider)
+	pending := routers
+
+	// The failures of the last complete round of checks, reported if we
+	// give up. Checks interrupted by the timeout itself aren't interesting.
+	var failures []error
+	for {
+		var round []error
+		var next []*router
+		for _, r := range pending {
+			if err := api.checkRouter(ctx, r.protocol, r.name, provider); err != nil {
+				round = append(round, err)
+				next = append(next, r)
+				continue
+			}
+			st.Step(terminal.StatusOK, fmt.Sprintf("Traefik %s router %q is enabled and healthy", r.protocol, r.name))
+		}
+		pending = next
+		if len(pending) == 0 {
+			return nil
+		}
+		if ctx.Err() == nil {
+			failures = round
+		}
+
+		st.Update(fmt.Sprintf("Waiting for Traefik to enable %d router(s)...", len(pending)))
+		select {
+		case <-ctx.Done():
+			for _, err := range failures {
+				st.Step(terminal.StatusError, err.Error())
+			}
+			names := make([]string, len(pending))
+			for i, r := range pending {
+				names[i] = r.name
+			}
+			return fmt.Errorf("Traefik did not enable router(s) %s within %s",
+				strings.Join(names, ", "), timeout)
+		case <-time.After(verifyWait):
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package release
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
+)
+
+// fakeStatus records the steps reported to it.
+type fakeStatus struct {
+	steps []string
+}
+
+func (s *fakeStatus) Update(msg string)       {}
+func (s *fakeStatus) Step(status, msg string) { s.steps = append(s.steps, status+": "+msg) }
+func (s *fakeStatus) Close() error            { return nil }
+
+// traefikStub serves docs, keyed by path, as the Traefik API would.
+func traefikStub(t *testing.T, docs map[string]interface{}) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doc, ok := docs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(doc)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// servers returns a load balancer with a server at each URL.
+func servers(urls ...string) map[string]interface{} {
+	var list []map[string]string
+	for _, u := range urls {
+		list = append(list, map[string]string{"url": u})
+	}
+	return map[string]interface{}{"servers": list}
+}
+
+func TestCheckRouter(t *testing.T) {
+	enabled := map[string]interface{}{
+		"name": "web@consulcatalog", "status": "enabled", "service": "web",
+	}
+
+	cases := []struct {
+		name    string
+		docs    map[string]interface{}
+		wantErr string
+	}{
+		{
+			name:    "router missing",
+			docs:    map[string]interface{}{},
+			wantErr: `router "web@consulcatalog" not found`,
+		},
+		{
+			name: "router disabled",
+			docs: map[string]interface{}{
+				"/api/http/routers/web@consulcatalog": map[string]interface{}{
+					"name": "web@consulcatalog", "status": "disabled", "service": "web",
+					"error": []string{"middleware \"auth@consulcatalog\" does not exist"},
+				},
+			},
+			wantErr: `router "web@consulcatalog" is disabled: middleware "auth@consulcatalog" does not exist`,
+		},
+		{
+			name: "service missing",
+			docs: map[string]interface{}{
+				"/api/http/routers/web@consulcatalog": enabled,
+			},
+			wantErr: `service "web@consulcatalog" of router "web@consulcatalog" not found`,
+		},
+		{
+			name: "no healthy servers",
+			docs: map[string]interface{}{
+				"/api/http/routers/web@consulcatalog": enabled,
+				"/api/http/services/web@consulcatalog": map[string]interface{}{
+					"status":       "enabled",
+					"loadBalancer": servers("http://10.0.0.1:8080"),
+					"serverStatus": map[string]string{"http://10.0.0.1:8080": "DOWN"},
+				},
+			},
+			wantErr: `service "web@consulcatalog" of router "web@consulcatalog" has no healthy servers`,
+		},
+		{
+			name: "no servers",
+			docs: map[string]interface{}{
+				"/api/http/routers/web@consulcatalog": enabled,
+				"/api/http/services/web@consulcatalog": map[string]interface{}{
+					"status": "enabled",
+				},
+			},
+			wantErr: `service "web@consulcatalog" of router "web@consulcatalog" has no healthy servers`,
+		},
+		{
+			name: "healthy",
+			docs: map[string]interface{}{
+				"/api/http/routers/web@consulcatalog": enabled,
+				"/api/http/services/web@consulcatalog": map[string]interface{}{
+					"status":       "enabled",
+					"loadBalancer": servers("http://10.0.0.1:8080", "http://10.0.0.2:8080"),
+					"serverStatus": map[string]string{
+						"http://10.0.0.1:8080": "DOWN",
+						"http://10.0.0.2:8080": "UP",
+					},
+				},
+			},
+		},
+		{
+			name: "healthy without health checks",
+			docs: map[string]interface{}{
+				"/api/http/routers/web@consulcatalog": enabled,
+				"/api/http/services/web@consulcatalog": map[string]interface{}{
+					"status":       "enabled",
+					"loadBalancer": servers("http://10.0.0.1:8080"),
+				},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := traefikStub(t, tc.docs)
+			err := newTraefikAPI(srv.URL).checkRouter(context.Background(), protocolHTTP, "web", "consulcatalog")
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %s", err)
+			case tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr):
+				t.Fatalf("expected error %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	// Routers published in Consul KV are loaded by the consul provider and
+	// reference the services of the consulcatalog provider.
+	srv := traefikStub(t, map[string]interface{}{
+		"/api/http/routers/web@consul": map[string]interface{}{
+			"name": "web@consul", "status": "enabled", "service": "web@consulcatalog",
+		},
+		"/api/http/services/web@consulcatalog": map[string]interface{}{
+			"status":       "enabled",
+			"loadBalancer": servers("http://10.0.0.1:8080"),
+		},
+	})
+	routers := []*router{
+		{name: "web", protocol: protocolHTTP},
+	}
+
+	t.Run("healthy", func(t *testing.T) {
+		st := &fakeStatus{}
+		c := &VerifyConfig{Address: srv.URL, Timeout: "1s"}
+		if err := c.verify(context.Background(), st, routers, providerConsulKV); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(st.steps) != 1 || !strings.HasPrefix(st.steps[0], terminal.StatusOK+": ") {
+			t.Errorf("expected one ok step, got %q", st.steps)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		st := &fakeStatus{}
+		c := &VerifyConfig{Address: srv.URL, Timeout: "100ms", Provider: "file"}
+		missing := append(routers, &router{name: "api", protocol: protocolHTTP})
+		err := c.verify(context.Background(), st, missing, providerConsulKV)
+		if want := "Traefik did not enable router(s) web, api within 100ms"; err == nil || err.Error() != want {
+			t.Fatalf("expected error %q, got %v", want, err)
+		}
+		want := []string{
+			terminal.StatusError + `: router "web@file" not found`,
+			terminal.StatusError + `: router "api@file" not found`,
+		}
+		if strings.Join(st.steps, "\n") != strings.Join(want, "\n") {
+			t.Errorf("expected steps %q, got %q", want, st.steps)
+		}
+	})
+}